@@ -16,21 +16,26 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/bmatcuk/doublestar"
 	"github.com/jroimartin/gocui"
+	"github.com/lhopki01/docker-chain-builder/dockerfile"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -39,51 +44,113 @@ import (
 type DependencyMap struct {
 	Registry        string
 	SemverComponent string
+	PreID           string
+	Metadata        string
+	PreRelease      string
 	BasePath        string
+	Parallelism     int
+	BuildRetry      RetryPolicy
+	PushRetry       RetryPolicy
+	Builder         Builder
 	DockerImages    DockerImages
-	Log             *bytes.Buffer
+	Log             *syncBuffer
+	State           *BuildState
 	RootImages      []string
+	guiImages       []string
+	bumpComponents  map[string]string
 }
 
+// DockerImages is keyed by the path of the image folder relative to the root folder.
+// Variants built from the same folder are keyed by folder:variant.
 type DockerImages map[string]*DockerImage
 
 type DockerImage struct {
-	Name               string
-	Image              string
-	Version            string
-	FromImage          string
-	DockerFile         []string
-	DockerFileFromLine int
-	Logs               *bytes.Buffer
-	BuildStatus        string
+	Name       string
+	Folder     string
+	Image      string
+	Version    string
+	Stages     []Stage
+	DockerFile *dockerfile.File
+	Config     ImageConfig
+	BuildArgs  map[string]string
+	Labels     map[string]string
+}
+
+// Stage is a single FROM instruction in a Dockerfile.
+// FromImage has any ARGs expanded, Image is the word as written in the Dockerfile.
+type Stage struct {
+	FromImage string
+	Alias     string
+	Line      int
+	Image     dockerfile.Word
 }
 
 const (
-	VersionNone  = "none"
-	VersionPre   = "pre"
-	VersionPatch = "patch"
-	VersionMinor = "minor"
-	VersionMajor = "major"
+	RepositoryNamingPath   = "path"
+	RepositoryNamingDashed = "dashed"
+	RepositoryNamingBase   = "base"
+)
+
+var (
+	RepositoryNamings = []string{
+		RepositoryNamingPath,
+		RepositoryNamingDashed,
+		RepositoryNamingBase,
+	}
+)
+
+const (
+	VersionNone    = "none"
+	VersionPre     = "pre"
+	VersionRelease = "release"
+	VersionPatch   = "patch"
+	VersionMinor   = "minor"
+	VersionMajor   = "major"
 )
 
 var (
 	Versions = []string{
 		VersionNone,
 		VersionPre,
+		VersionRelease,
 		VersionPatch,
 		VersionMinor,
 		VersionMajor,
 	}
 )
 
+// PropagateSame bumps images built from a bumped image by the same component as it
+const PropagateSame = "same"
+
 var (
-	bumpComponent  string
-	sinceCommit    string
-	dryRun         bool
-	noCache        bool
-	nonInteractive bool
-	push           bool
-	verbose        bool
+	PropagationPolicies = append([]string{PropagateSame}, Versions...)
+)
+
+var (
+	buildArgFlags      []string
+	buildAttempts      int
+	builderName        string
+	buildMetadata      string
+	bumpComponent      string
+	sinceCommit        string
+	timeout            time.Duration
+	dryRun             bool
+	imageTimeout       time.Duration
+	failFast           bool
+	gitPreReleaseBuild bool
+	keepGoing          bool
+	noCache            bool
+	nonInteractive     bool
+	parallelism        int
+	pinDigests         bool
+	preID              string
+	propagate          string
+	push               bool
+	pushAttempts       int
+	secretFlags        []string
+	sshFlags           []string
+	verbose            bool
+	workspaceBuild     bool
 )
 
 // buildCmd represents the build command
@@ -92,7 +159,7 @@ var buildCmd = &cobra.Command{
 	Short: "Build docker image and all docker images that depend on it",
 	Long: `Find all images that depend on specified source images and build them in order.
 If multiple source folders are specified they are deduplicated and each dependency chain is only walked once.
-All source folders must be in the same folder.`,
+All source folders must be under the same root folder (the closest folder above them containing conf.yaml).`,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
 			return fmt.Errorf("please specify at least one source folder")
@@ -100,32 +167,141 @@ All source folders must be in the same folder.`,
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		viper.Set("rootFolder", filepath.Dir(filepath.Clean(args[0])))
+		viper.Set("rootFolder", findRootFolder(args[0]))
 		loadConfFile()
 		if verbose {
 			log.SetLevel(log.DebugLevel)
 		} else {
 			log.SetLevel(log.InfoLevel)
 		}
-		var buf bytes.Buffer
+		buf := &syncBuffer{}
 		if !nonInteractive && !dryRun {
 			log.SetLevel(log.WarnLevel)
-			log.SetOutput(&buf)
+			log.SetOutput(buf)
+		}
+		if !cmd.Flags().Changed("pin-digests") {
+			pinDigests = viper.GetBool("pinDigests")
+		}
+		if pinDigests && !push {
+			log.SetOutput(os.Stderr)
+			log.Fatal("pinning digests requires --push")
+		}
+		if failFast && keepGoing {
+			log.SetOutput(os.Stderr)
+			log.Fatal("--fail-fast and --keep-going can't be used together")
+		}
+		if !cmd.Flags().Changed("fail-fast") && !keepGoing {
+			failFast = viper.GetBool("failFast")
+		}
+		if !cmd.Flags().Changed("parallelism") {
+			parallelism = viper.GetInt("parallelism")
+		}
+		if !cmd.Flags().Changed("timeout") {
+			timeout = viper.GetDuration("timeout")
+		}
+		if !cmd.Flags().Changed("image-timeout") {
+			imageTimeout = viper.GetDuration("imageTimeout")
 		}
 		dm := DependencyMap{}
 		dm.initDepencyMap(args)
+		buf.Redact(dm.State.secrets)
+		dm.Parallelism = parallelism
+		if dm.Parallelism <= 0 {
+			dm.Parallelism = runtime.NumCPU()
+		}
+		dm.BuildRetry = loadRetryPolicy("build", buildAttempts)
+		dm.PushRetry = loadRetryPolicy("push", pushAttempts)
+		if !cmd.Flags().Changed("builder") && viper.IsSet("builder") {
+			builderName = viper.GetString("builder")
+		}
+		builder, err := newBuilder(builderName)
+		if err != nil {
+			log.SetOutput(os.Stderr)
+			log.Fatal(err)
+		}
+		dm.Builder = builder
+		if !dryRun {
+			if err := dm.checkPlatforms(); err != nil {
+				log.SetOutput(os.Stderr)
+				log.Fatal(err)
+			}
+		}
+		if gitPreReleaseBuild {
+			preReleaseTemplate := viper.GetString("gitPreReleaseTemplate")
+			if preReleaseTemplate == "" {
+				preReleaseTemplate = DefaultGitPreRelease
+			}
+			dm.PreRelease, err = gitPreRelease(preReleaseTemplate)
+			if err != nil {
+				log.SetOutput(os.Stderr)
+				log.Fatal(err)
+			}
+			log.Infof("building pre-release %s", dm.PreRelease)
+		}
+		// Pre-release builds rewrite VERSION files and FROM lines in a copy of the root folder, which
+		// workspace builds only write back once every image has been built
+		if !cmd.Flags().Changed("workspace") {
+			workspaceBuild = viper.GetBool("workspace")
+		}
+		// Plan the bump before the gui starts so one that can't be made is reported on the terminal
+		log.SetOutput(os.Stderr)
+		plan := dm.planBump(dm.RootImages)
+		if !nonInteractive && !dryRun {
+			log.SetOutput(buf)
+		}
+		rootFolder := dm.BasePath
+		workspace := ""
+		if (workspaceBuild || dm.PreRelease != "") && !dryRun {
+			workspace, err = dm.newWorkspace()
+			if err != nil {
+				log.SetOutput(os.Stderr)
+				log.Fatalf("couldn't create workspace: %v", err)
+			}
+			dm.BasePath = workspace
+			// The workspace is a copy of the root folder so the plan applies to it as it is
+			plan.Root = workspace
+		}
 
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if timeout > 0 {
+			var cancelTimeout context.CancelFunc
+			ctx, cancelTimeout = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("build timed out after %s", timeout))
+			defer cancelTimeout()
+		}
 		if nonInteractive || dryRun {
-			dm.build()
+			dm.build(ctx, plan)
 		} else {
-			dm.Log = &buf
-			go dm.build()
+			dm.Log = buf
+			ctx, quit := context.WithCancelCause(ctx)
+			done := make(chan struct{})
+			go func() {
+				dm.build(ctx, plan)
+				close(done)
+			}()
 			gui(&dm)
+			// Interrupt any docker processes still running and wait for them to exit
+			quit(fmt.Errorf("quit before the build finished"))
+			<-done
+			dm.State.CancelUnfinished("quit before the build finished")
+		}
+		if !dryRun {
+			dm.State.PrintSummary(os.Stdout)
 		}
-		for _, image := range dm.DockerImages {
-			if image.BuildStatus == "failure" {
-				os.Exit(1)
+		if workspace != "" {
+			log.SetOutput(os.Stderr)
+			if dm.PreRelease == "" && !dm.State.Failed() {
+				if err := dm.writeBack(workspace, rootFolder); err != nil {
+					os.RemoveAll(workspace)
+					log.Fatalf("couldn't write changes back to %s: %v", rootFolder, err)
+				}
+			} else if dm.PreRelease == "" {
+				log.Warnf("not writing changes back to %s as the build failed", rootFolder)
 			}
+			os.RemoveAll(workspace)
+		}
+		if dm.State.Failed() {
+			os.Exit(1)
 		}
 	},
 }
@@ -134,15 +310,78 @@ func init() {
 	rootCmd.AddCommand(buildCmd)
 
 	helpBump := fmt.Sprintf("semver component to bump [%s]", strings.Join(Versions, "|"))
+	helpPropagate := fmt.Sprintf("semver component to bump images built from a bumped image by [%s] (default same or propagate in conf.yaml)", strings.Join(PropagationPolicies, "|"))
+
 	buildCmd.Flags().StringVar(&bumpComponent, "bump", VersionNone, helpBump)
+	buildCmd.Flags().StringVar(&preID, "preid", "", "identifier of a pre-release started by --bump pre, e.g. rc")
+	buildCmd.Flags().StringVar(&buildMetadata, "metadata", "", "build metadata to add to every bumped version, e.g. build.5")
+	buildCmd.Flags().StringVar(&propagate, "propagate", "", helpPropagate)
 	buildCmd.Flags().StringVar(&sinceCommit, "since-commit", "", "only images changes since specified commit")
 	buildCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "show what would happen")
 	buildCmd.Flags().BoolVar(&noCache, "no-cache", false, "do not use cache when building the images")
+	helpBuilder := fmt.Sprintf("tool used to build and push images [%s]", strings.Join(Builders, "|"))
+	buildCmd.Flags().StringVar(&builderName, "builder", BuilderDocker, helpBuilder)
+	buildCmd.Flags().StringArrayVar(&buildArgFlags, "build-arg", nil, "set a build arg for every image, KEY=VALUE or KEY to take it from the environment")
+	buildCmd.Flags().StringArrayVar(&secretFlags, "secret", nil, "secret to expose to every build, e.g. id=npmrc,src=$HOME/.npmrc")
+	buildCmd.Flags().StringArrayVar(&sshFlags, "ssh", nil, "ssh agent socket or keys to expose to every build, e.g. default")
 	buildCmd.Flags().BoolVar(&push, "push", false, "push images to registry")
+	buildCmd.Flags().BoolVar(&pinDigests, "pin-digests", false, "pin FROM lines to the digest of each parent image once it is pushed")
+	buildCmd.Flags().BoolVar(&gitPreReleaseBuild, "git-pre-release", false, "build a pre-release named after the git branch and commit without changing the working tree")
 	buildCmd.Flags().BoolVar(&nonInteractive, "non-interactive", false, "don't use the gui to display the build")
+	buildCmd.Flags().BoolVar(&failFast, "fail-fast", false, "stop every build in progress as soon as one image fails")
+	buildCmd.Flags().BoolVar(&keepGoing, "keep-going", false, "keep building images that don't depend on a failed image (default unless failFast is set in conf.yaml)")
+	buildCmd.Flags().IntVarP(&parallelism, "parallelism", "j", 0, "maximum number of images to build at once (default number of CPUs)")
+	buildCmd.Flags().DurationVar(&timeout, "timeout", 0, "cancel the whole build if it takes longer than this, e.g. 1h")
+	buildCmd.Flags().DurationVar(&imageTimeout, "image-timeout", 0, "fail an image if building and pushing it takes longer than this, e.g. 15m")
+	buildCmd.Flags().IntVar(&buildAttempts, "build-attempts", 0, "times to attempt docker build before giving up (default 1 or retries.build.attempts in conf.yaml)")
+	buildCmd.Flags().IntVar(&pushAttempts, "push-attempts", 0, "times to attempt docker push before giving up (default 1 or retries.push.attempts in conf.yaml)")
+	buildCmd.Flags().BoolVar(&workspaceBuild, "workspace", false, "bump and build in a temporary copy of the root folder and only write the changes back if every image builds")
 	buildCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose mode")
 }
 
+// findRootFolder walks up from the parent of folder looking for conf.yaml so images in nested folders
+// share the same root.  The walk stops at the top of the git repository holding folder or, outside git,
+// at the working directory if folder is inside it, so a conf.yaml in an unrelated folder such as $HOME
+// is never used.  If no conf.yaml is found the parent of folder is used.
+func findRootFolder(folder string) string {
+	parent := filepath.Dir(filepath.Clean(folder))
+	absParent, err := filepath.Abs(parent)
+	if err != nil {
+		return parent
+	}
+	// Compare folders with symlinks resolved as that is how git reports its top level
+	top := resolveSymlinks(absParent)
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+	cmd.Dir = absParent
+	if output, err := cmd.Output(); err == nil {
+		top = resolveSymlinks(strings.TrimSpace(string(output)))
+	} else if wd, err := os.Getwd(); err == nil {
+		wd = resolveSymlinks(wd)
+		if rel, err := filepath.Rel(wd, top); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			top = wd
+		}
+	}
+	for dir := absParent; ; {
+		if _, err := os.Stat(filepath.Join(dir, "conf.yaml")); err == nil {
+			if dir == absParent {
+				return parent
+			}
+			return dir
+		}
+		if filepath.Dir(dir) == dir || resolveSymlinks(dir) == top {
+			return parent
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func resolveSymlinks(folder string) string {
+	if resolved, err := filepath.EvalSymlinks(folder); err == nil {
+		return resolved
+	}
+	return folder
+}
+
 func loadConfFile() {
 	viper.SetConfigFile(fmt.Sprintf("%s/conf.yaml", viper.GetString("rootFolder")))
 	err := viper.ReadInConfig()
@@ -153,8 +392,8 @@ func loadConfFile() {
 	}
 }
 
-func imagesChangedSinceCommit(images []string) []string {
-	cmd := exec.Command("git", "diff", "--ignore-all-space", "--name-only", sinceCommit, "--", "*")
+func (dm *DependencyMap) imagesChangedSinceCommit(images []string) []string {
+	cmd := exec.Command("git", "diff", "--ignore-all-space", "--name-only", "--relative", sinceCommit, "--", "*")
 	cmd.Dir = viper.GetString("rootFolder")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -165,8 +404,9 @@ func imagesChangedSinceCommit(images []string) []string {
 	var changedRootFolders []string
 	for _, line := range lines {
 		for _, image := range images {
-			log.Debug("Comparing: %s to %s", fmt.Sprintf("*/%s/**"))
-			match, err := doublestar.PathMatch(fmt.Sprintf("*/%s/**", image), filepath.Clean(line))
+			folder := dm.DockerImages[image].Folder
+			log.Debugf("Comparing: %s to %s", fmt.Sprintf("%s/**", folder), line)
+			match, err := doublestar.PathMatch(fmt.Sprintf("%s/**", folder), filepath.Clean(line))
 			if err != nil {
 				log.Warnf("couldn't match image %s with %s", image, line)
 			}
@@ -200,28 +440,115 @@ func (dm *DependencyMap) initDepencyMap(args []string) {
 		log.SetOutput(os.Stderr)
 		log.Fatalf("%s invalid semver component; choose from %v", bumpComponent, Versions)
 	}
+	if preID != "" {
+		if dm.SemverComponent != VersionPre {
+			log.SetOutput(os.Stderr)
+			log.Fatalf("--preid only applies to --bump %s", VersionPre)
+		}
+		if _, err := semver.NewVersion("0.0.0-" + preID); err != nil {
+			log.SetOutput(os.Stderr)
+			log.Fatalf("%s invalid pre-release identifier", preID)
+		}
+		dm.PreID = preID
+	}
+	if buildMetadata != "" {
+		if _, err := semver.NewVersion("0.0.0+" + buildMetadata); err != nil {
+			log.SetOutput(os.Stderr)
+			log.Fatalf("%s invalid build metadata", buildMetadata)
+		}
+		dm.Metadata = buildMetadata
+	}
 
 	dm.BasePath = viper.GetString("rootFolder")
 
-	dm.DockerImages = generateDockerImagesMap(dm.BasePath, dm.Registry)
+	repositoryNaming := viper.GetString("repositoryNaming")
+	if repositoryNaming == "" {
+		repositoryNaming = RepositoryNamingPath
+	}
+	if !stringInSlice(repositoryNaming, RepositoryNamings) {
+		log.SetOutput(os.Stderr)
+		log.Fatalf("%s invalid repositoryNaming; choose from %v", repositoryNaming, RepositoryNamings)
+	}
+
+	defaults := ImageConfig{
+		Propagate:    PropagateSame,
+		Timeout:      imageTimeout,
+		Platforms:    viper.GetStringSlice("platforms"),
+		BuildArgs:    viper.GetStringSlice("buildArgs"),
+		Target:       viper.GetString("target"),
+		Dockerfile:   DefaultDockerfile,
+		Context:      DefaultContext,
+		Tags:         viper.GetStringSlice("tags"),
+		FloatingTags: viper.GetStringSlice("floatingTags"),
+		Labels:       viper.GetStringSlice("labels"),
+		SkipPush:     viper.GetBool("skipPush"),
+		Secrets:      viper.GetStringSlice("secrets"),
+		SSH:          viper.GetStringSlice("ssh"),
+	}
+	if viper.GetString("dockerfile") != "" {
+		defaults.Dockerfile = viper.GetString("dockerfile")
+	}
+	if viper.GetString("context") != "" {
+		defaults.Context = viper.GetString("context")
+	}
+	if viper.IsSet("propagate") {
+		defaults.Propagate = viper.GetString("propagate")
+	}
+	if viper.IsSet("latest") {
+		latest := viper.GetBool("latest")
+		defaults.Latest = &latest
+	}
+	if viper.IsSet("preReleaseFloatingTags") {
+		preReleaseFloatingTags := viper.GetBool("preReleaseFloatingTags")
+		defaults.PreReleaseFloatingTags = &preReleaseFloatingTags
+	}
+	// Flags override every conf file
+	overrides := ImageConfig{BuildArgs: buildArgFlags, Propagate: propagate, Secrets: secretFlags, SSH: sshFlags}
+	dm.DockerImages = generateDockerImagesMap(dm.BasePath, dm.Registry, repositoryNaming, defaults, loadImageConfigs(), overrides)
+	for folder, dockerImage := range dm.DockerImages {
+		if !stringInSlice(dockerImage.Config.Propagate, PropagationPolicies) {
+			log.SetOutput(os.Stderr)
+			log.Fatalf("%s invalid propagate for %s; choose from %v", dockerImage.Config.Propagate, folder, PropagationPolicies)
+		}
+	}
+	folders := make([]string, 0, len(dm.DockerImages))
+	for folder := range dm.DockerImages {
+		folders = append(folders, folder)
+	}
+	dm.State = newBuildState(folders)
+	var secrets []string
+	for _, dockerImage := range dm.DockerImages {
+		secrets = append(secrets, dockerImage.Config.Secrets...)
+	}
+	dm.State.Redact(secretValues(unique(secrets)))
+	if err := dm.checkForCycles(); err != nil {
+		log.SetOutput(os.Stderr)
+		log.Fatal(err)
+	}
 
 	dm.RootImages = dm.getRootFolders(args)
+	dm.bumpComponents = dm.resolveBumpComponents(dm.RootImages)
 }
 
 func (dm *DependencyMap) getRootFolders(args []string) []string {
 	var argImages []string
 	for _, arg := range args {
-		if _, err := os.Stat(fmt.Sprintf("%s/Dockerfile", filepath.Clean(arg))); err != nil {
+		folder, err := dm.relativeFolder(arg)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		images := dm.imagesInFolder(folder)
+		if len(images) == 0 {
 			log.Warnf("no Dockerfile in %s\n", arg)
 			continue
-		} else {
-			argImages = append(argImages, filepath.Base(arg))
 		}
+		argImages = append(argImages, images...)
 	}
 	log.Debug("====after sinceCommit======")
 	log.Debug(argImages)
 	if sinceCommit != "" {
-		argImages = imagesChangedSinceCommit(argImages)
+		argImages = dm.imagesChangedSinceCommit(argImages)
 	}
 	log.Debug("====after sinceCommit======")
 	log.Debug(argImages)
@@ -242,6 +569,69 @@ func (dm *DependencyMap) getRootFolders(args []string) []string {
 	return rootImages
 }
 
+// parseBuildArgs turns a list of KEY=VALUE build args into a map.  A KEY on its own takes its value
+// from the environment the same way docker build does, and is left out if it isn't set.
+func parseBuildArgs(buildArgs []string) map[string]string {
+	var keyValues []string
+	for _, buildArg := range buildArgs {
+		if strings.Contains(buildArg, "=") {
+			keyValues = append(keyValues, buildArg)
+		} else if value, ok := os.LookupEnv(buildArg); ok {
+			keyValues = append(keyValues, fmt.Sprintf("%s=%s", buildArg, value))
+		} else {
+			log.Warnf("not passing build arg %s as it isn't set in the environment", buildArg)
+		}
+	}
+	return parseKeyValues("build arg", keyValues)
+}
+
+// parseKeyValues turns a list of KEY=VALUE strings, such as build args or labels, into a map.
+// Later values of the same key override earlier ones.
+func parseKeyValues(kind string, keyValues []string) map[string]string {
+	parsed := make(map[string]string)
+	for _, keyValue := range keyValues {
+		kv := strings.SplitN(keyValue, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.SetOutput(os.Stderr)
+			log.Fatalf("%s invalid %s; must be KEY=VALUE", keyValue, kind)
+		}
+		parsed[kv[0]] = kv[1]
+	}
+	return parsed
+}
+
+// imagesInFolder returns every image built from folder, sorted
+func (dm *DependencyMap) imagesInFolder(folder string) []string {
+	var images []string
+	for image, dockerImage := range dm.DockerImages {
+		if dockerImage.Folder == folder {
+			images = append(images, image)
+		}
+	}
+	sort.Strings(images)
+	return images
+}
+
+// relativeFolder converts a folder given on the command line to its key in DockerImages
+func (dm *DependencyMap) relativeFolder(arg string) (string, error) {
+	absBase, err := filepath.Abs(dm.BasePath)
+	if err != nil {
+		return "", err
+	}
+	absArg, err := filepath.Abs(arg)
+	if err != nil {
+		return "", err
+	}
+	folder, err := filepath.Rel(absBase, absArg)
+	if err != nil {
+		return "", err
+	}
+	if folder == "." || strings.HasPrefix(folder, "..") {
+		return "", fmt.Errorf("%s is not inside %s", arg, dm.BasePath)
+	}
+	return filepath.ToSlash(folder), nil
+}
+
 func stringInSlice(str string, slc []string) bool {
 	for _, s := range slc {
 		if s == str {
@@ -252,15 +642,8 @@ func stringInSlice(str string, slc []string) bool {
 }
 
 func (dm *DependencyMap) getChildren(folder string) []string {
-	folderDockerImage, ok := dm.DockerImages[folder]
-	if ok {
-		var children []string
-		for key, dockerImage := range dm.DockerImages {
-			log.Debugf("Comparing %s to %s\n", dockerImage.FromImage, folderDockerImage.Image)
-			if dockerImage.FromImage == folderDockerImage.Image {
-				children = append(children, key)
-			}
-		}
+	if _, ok := dm.DockerImages[folder]; ok {
+		children := dm.getDependents(folder)
 		if len(children) > 0 {
 			for _, child := range children {
 				children = append(children, dm.getChildren(child)...)
@@ -271,260 +654,758 @@ func (dm *DependencyMap) getChildren(folder string) []string {
 	return []string{}
 }
 
-func (dm *DependencyMap) build() {
+// getDependents returns the images that have at least one stage built FROM folder's image
+func (dm *DependencyMap) getDependents(folder string) []string {
+	var dependents []string
+	for key, dockerImage := range dm.DockerImages {
+		log.Debugf("Comparing stages of %s to %s\n", key, dm.DockerImages[folder].Image)
+		if dockerImage.dependsOn(dm.DockerImages[folder].Image) {
+			dependents = append(dependents, key)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+func (di *DockerImage) dependsOn(image string) bool {
+	for _, stage := range di.Stages {
+		if stage.isFrom(image) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFrom reports whether the stage is built from image ignoring any digest the FROM is pinned to
+func (s Stage) isFrom(image string) bool {
+	ref := dockerfile.ParseReference(s.FromImage)
+	ref.Digest = ""
+	return ref.String() == image
+}
+
+// build applies plan and builds every image.  If plan can't be applied nothing is built.
+func (dm *DependencyMap) build(ctx context.Context, plan *BumpPlan) {
 	//log.SetLevel(log.ErrorLevel)
 	log.Debugf("%v", dm)
-	dm.updateVersions(dm.RootImages, false)
-	dm.buildDockerImages(dm.RootImages)
+	if dryRun {
+		plan.logChanges()
+	} else if err := plan.apply(); err != nil {
+		reason := fmt.Sprintf("couldn't update versions: %v", err)
+		log.Error(reason)
+		for _, folder := range dm.imagesToBuild(dm.RootImages) {
+			dm.State.SetFinished(folder, StatusCancelled, 0, reason)
+		}
+		return
+	}
+	dm.buildDockerImages(ctx, dm.RootImages)
 }
 
-func bumpVersion(version string, semverComponent string) (newVersion []string) {
+// bumpVersion returns version with semverComponent bumped.  A pre bump increments the last number in the
+// pre-release, e.g. 1.2.4-rc.3 to 1.2.4-rc.4, or starts a pre-release of the next patch, e.g. 1.2.3 to
+// 1.2.4-rc.0 with preID rc.  A pre bump never goes backwards, so a preID that sorts below the current one
+// starts a pre-release of the next patch, e.g. 1.2.4-beta.2 to 1.2.5-alpha.0 with preID alpha.
+// A release bump drops the pre-release and major, minor and patch bumps keep it.  Every bump drops build metadata.
+func bumpVersion(version string, semverComponent string, preID string) (string, error) {
 	log.Debugf("version string is: %s", version)
 	v, err := semver.NewVersion(version)
 	if err != nil {
 		log.Warnf("%s not semver so can't bump", version)
-		return []string{version}
+		return version, nil
 	}
+	if semverComponent == VersionNone {
+		return v.String(), nil
+	}
+	major, minor, patch := v.Major(), v.Minor(), v.Patch()
 	preRelease := v.Prerelease()
 	log.Debugf("preRelease is: %s", preRelease)
 	switch semverComponent {
-	case VersionNone:
-		break
 	case VersionPre:
-		newPreRelease, err := strconv.Atoi(preRelease)
-		if err != nil {
-			log.Fatalf("can't parse pre-release %s to increment", preRelease)
+		if preRelease == "" {
+			patch++
 		}
-		newPreRelease += 1
-		preRelease = strconv.Itoa(newPreRelease)
-	case VersionMinor:
-		*v = v.IncMinor()
+		preRelease = nextPreRelease(preRelease, preID)
+		if next, err := semver.NewVersion(fmt.Sprintf("%d.%d.%d-%s", major, minor, patch, preRelease)); err == nil && !next.GreaterThan(v) {
+			patch++
+			preRelease = nextPreRelease("", preID)
+		}
+	case VersionRelease:
+		preRelease = ""
 	case VersionPatch:
-		*v = v.IncPatch()
+		patch++
+	case VersionMinor:
+		minor, patch = minor+1, 0
 	case VersionMajor:
-		*v = v.IncMajor()
+		major, minor, patch = major+1, 0, 0
 	default:
-		log.Fatalf("don't understand semverComponent %s", semverComponent)
+		return "", fmt.Errorf("don't understand semverComponent %s", semverComponent)
 	}
-	versions := []string{}
 
+	newVersion := fmt.Sprintf("%d.%d.%d", major, minor, patch)
 	if preRelease != "" {
-		log.Debug("newPreRelease")
-		*v, err = v.SetPrerelease(preRelease)
-		if err != nil {
-			log.Fatalf("failed to add pre-release %s with err %v", preRelease, err)
+		newVersion += "-" + preRelease
+	}
+	if _, err := semver.NewVersion(newVersion); err != nil {
+		return "", fmt.Errorf("can't bump %s to %s: %v", version, newVersion, err)
+	}
+	return newVersion, nil
+}
+
+// nextPreRelease increments the last numeric identifier of preRelease, adding .0 if there isn't one.
+// A preID other than the first identifier of preRelease starts again at preID.0.
+func nextPreRelease(preRelease string, preID string) string {
+	identifiers := strings.Split(preRelease, ".")
+	if preRelease == "" || (preID != "" && identifiers[0] != preID) {
+		if preID == "" {
+			return "0"
 		}
-		versions = append(versions, v.String())
+		return preID + ".0"
 	}
+	for i := len(identifiers) - 1; i >= 0; i-- {
+		if n, err := strconv.ParseUint(identifiers[i], 10, 64); err == nil {
+			identifiers[i] = strconv.FormatUint(n+1, 10)
+			return strings.Join(identifiers, ".")
+		}
+	}
+	return preRelease + ".0"
+}
 
-	versions = append(versions,
-		fmt.Sprintf("%d.%d.%d", v.Major(), v.Minor(), v.Patch()),
-		fmt.Sprintf("%d.%d", v.Major(), v.Minor()),
-		fmt.Sprintf("%d", v.Major()),
-	)
+// bumpComponentOf returns the semver component folder is bumped by, as worked out by resolveBumpComponents
+func (dm *DependencyMap) bumpComponentOf(folder string) string {
+	if component, ok := dm.bumpComponents[folder]; ok {
+		return component
+	}
+	return dm.SemverComponent
+}
 
-	return versions
+// resolveBumpComponents works out the semver component every image imagesToBuild gives for images is bumped by.
+// Images given on the command line are bumped by --bump and every image built from them by its propagate
+// setting, with same meaning the component its parent was bumped by.  An image built from several bumped
+// images takes the largest of their components, as do the variants of a folder as they share its VERSION.
+// Nothing is bumped below an image that isn't bumped, so nothing is bumped at all with --bump none.
+func (dm *DependencyMap) resolveBumpComponents(images []string) map[string]string {
+	nodes := dm.imagesToBuild(images)
+	parents := make(map[string][]string)
+	for _, image := range nodes {
+		for _, child := range dm.getDependents(image) {
+			parents[child] = append(parents[child], image)
+		}
+	}
+
+	// Components are worked out for each folder.  A variant built, directly or through other images,
+	// from another variant of its own folder is bumped along with it so that parent is ignored.
+	folderComponents := make(map[string]string)
+	resolving := make(map[string]bool)
+	var resolve func(folder string) string
+	resolve = func(folder string) string {
+		if component, ok := folderComponents[folder]; ok {
+			return component
+		}
+		if resolving[folder] {
+			return VersionNone
+		}
+		resolving[folder] = true
+		component := VersionNone
+		for _, image := range dm.imagesInFolder(folder) {
+			c := dm.SemverComponent
+			if !stringInSlice(image, images) {
+				parentComponent := VersionNone
+				for _, parent := range parents[image] {
+					if pc := resolve(dm.DockerImages[parent].Folder); versionIndex(pc) > versionIndex(parentComponent) {
+						parentComponent = pc
+					}
+				}
+				c = dm.DockerImages[image].Config.Propagate
+				if parentComponent == VersionNone || c == PropagateSame {
+					c = parentComponent
+				}
+			}
+			if versionIndex(c) > versionIndex(component) {
+				component = c
+			}
+		}
+		// A bump that leaves the version as it is, e.g. release of a version that isn't a pre-release, bumps nothing
+		version := dm.DockerImages[dm.imagesInFolder(folder)[0]].Version
+		if _, err := semver.NewVersion(version); err == nil {
+			if newVersion, err := dm.nextVersion(version, component); err == nil && newVersion == version {
+				component = VersionNone
+			}
+		}
+		folderComponents[folder] = component
+		return component
+	}
+
+	components := make(map[string]string)
+	for _, image := range nodes {
+		components[image] = resolve(dm.DockerImages[image].Folder)
+	}
+	return components
 }
 
-func (dm *DependencyMap) updateVersionFile(folder string) {
-	newVersion := bumpVersion(dm.DockerImages[folder].Version, dm.SemverComponent)
-	newContent := []byte(newVersion[0] + "\n")
-	file := fmt.Sprintf("%s/%s/VERSION", dm.BasePath, folder)
-	if dryRun {
-		log.Info(fmt.Sprintf("would write to '%s' to %s", newVersion[0], file))
+// keepsVersion reports whether folder is left as it is, neither bumped nor built, as nothing it is built from
+// is bumped or its propagate setting leaves its version as it is.  With --bump none every image is rebuilt as it is.
+func (dm *DependencyMap) keepsVersion(folder string) bool {
+	return dm.SemverComponent != VersionNone && dm.bumpComponentOf(folder) == VersionNone
+}
 
-	} else {
-		err := ioutil.WriteFile(file, newContent, 0644)
-		if err != nil {
-			log.Fatalf("couldn't write %s to file %s", newContent, file)
+// versionIndex orders the semver components from none to major
+func versionIndex(component string) int {
+	for i, version := range Versions {
+		if version == component {
+			return i
 		}
 	}
+	return -1
+}
+
+// nextVersion is the version an image or FROM line at version is built as when bumped by semverComponent.
+// For a pre-release build the pre-release is replaced with the one derived from git.  Build metadata is added last.
+func (dm *DependencyMap) nextVersion(version string, semverComponent string) (string, error) {
+	newVersion, err := bumpVersion(version, semverComponent, dm.PreID)
+	if err != nil || (dm.PreRelease == "" && dm.Metadata == "") {
+		return newVersion, err
+	}
+	v, err := semver.NewVersion(newVersion)
+	if err != nil {
+		log.Warnf("%s not semver so can't add pre-release %s or build metadata %s", newVersion, dm.PreRelease, dm.Metadata)
+		return newVersion, nil
+	}
+	if dm.PreRelease != "" {
+		if *v, err = v.SetPrerelease(dm.PreRelease); err != nil {
+			return "", fmt.Errorf("failed to add pre-release %s to %s with err %v", dm.PreRelease, newVersion, err)
+		}
+	}
+	if dm.Metadata != "" {
+		if *v, err = v.SetMetadata(dm.Metadata); err != nil {
+			return "", fmt.Errorf("failed to add build metadata %s to %s with err %v", dm.Metadata, newVersion, err)
+		}
+	}
+	return v.String(), nil
+}
+
+// planVersionFile adds the new VERSION of folder to plan
+func (dm *DependencyMap) planVersionFile(plan *BumpPlan, folder string) error {
+	oldVersion := dm.DockerImages[folder].Version
+	newVersion, err := dm.nextVersion(oldVersion, dm.bumpComponentOf(folder))
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dm.DockerImages[folder].Folder, "VERSION")
+	// Keep whatever the file ends with so only the version itself changes
+	ending := "\n"
+	if content, err := ioutil.ReadFile(filepath.Join(dm.BasePath, file)); err == nil && len(content) > 0 {
+		ending = string(content[len(bytes.TrimRight(content, "\r\n")):])
+	}
+	plan.set(file, []byte(newVersion+ending), Change{
+		Image:      folder,
+		OldVersion: oldVersion,
+		NewVersion: newVersion,
+		Line:       1,
+	})
+	return nil
 }
 
-func (dm *DependencyMap) updateDockerFile(folder string) {
+// planDockerFile adds every FROM line in folder's Dockerfile that references parent's image to plan.
+// The new tag is always derived from the original FROM so calling it more than once is harmless.
+func (dm *DependencyMap) planDockerFile(plan *BumpPlan, folder string, parent string) error {
 	dockerFile := dm.DockerImages[folder].DockerFile
-	idx := dm.DockerImages[folder].DockerFileFromLine
-	fromLine := dockerFile[idx]
-	fromLineSplit := strings.Split(fromLine, ":")
-	log.Debug(fromLineSplit)
-	if len(fromLineSplit) > 2 {
-		log.Fatalf("can't parse FROM: %s", fromLine)
+	file := dm.dockerFilePath(folder)
+	relFile := filepath.Join(dm.DockerImages[folder].Folder, dm.DockerImages[folder].Config.Dockerfile)
+	for _, stage := range dm.DockerImages[folder].Stages {
+		if !stage.isFrom(dm.DockerImages[parent].Image) {
+			continue
+		}
+		ref := dockerfile.ParseReference(stage.FromImage)
+		log.Debug(ref)
+		if ref.Tag == "" {
+			return fmt.Errorf("can't parse FROM: %s", dockerFile.Line(stage.Line))
+		}
+		// Tags hold build metadata after a _ rather than a +
+		newVersion, err := dm.nextVersion(tagVersion(ref.Tag), dm.bumpComponentOf(parent))
+		if err != nil {
+			return err
+		}
+		newVersion = versionTag(newVersion)
+		if newVersion == ref.Tag {
+			// The digest is still for this tag so the line is left as it is
+			continue
+		}
+		if ref.Digest != "" {
+			log.Debugf("dropping digest %s from FROM line %d of %s as it is for the old tag", ref.Digest, stage.Line, file)
+		}
+		change := Change{Image: folder, OldVersion: ref.Tag, NewVersion: newVersion, Line: stage.Line}
+
+		// The version may be written in the FROM line or in the default of an ARG used by it
+		rawRef := dockerfile.ParseReference(stage.Image.Value)
+		rawTagArgs := dockerfile.Variables(rawRef.Tag)
+		rawRef.Digest = ""
+		if len(rawTagArgs) == 0 {
+			rawRef.Tag = newVersion
+			dockerFile.Replace(stage.Image, rawRef.String())
+			plan.set(relFile, dockerFile.Bytes(), change)
+			continue
+		}
+
+		argName := rawTagArgs[0]
+		if len(rawTagArgs) > 1 || (rawRef.Tag != "$"+argName && rawRef.Tag != "${"+argName+"}") {
+			return fmt.Errorf("can't update FROM on line %d of %s as the tag %s is not a single ARG", stage.Line, file, rawRef.Tag)
+		}
+		if _, ok := dm.DockerImages[folder].BuildArgs[argName]; ok {
+			return fmt.Errorf("can't update FROM on line %d of %s as %s is set in buildArgs", stage.Line, file, argName)
+		}
+		arg, ok := dm.DockerImages[folder].globalArg(argName)
+		if !ok || !arg.HasDefault || len(dockerfile.Variables(arg.Default.Value)) > 0 {
+			return fmt.Errorf("can't update FROM on line %d of %s as ARG %s has no literal default before the first FROM", stage.Line, file, argName)
+		}
+		dockerFile.Replace(arg.Default, newVersion)
+		if ref.Digest != "" {
+			dockerFile.Replace(stage.Image, rawRef.String())
+			plan.set(relFile, dockerFile.Bytes(), change)
+		}
+		change.Line = arg.Instruction.Line
+		plan.set(relFile, dockerFile.Bytes(), change)
 	}
+	return nil
+}
 
-	newVersion := bumpVersion(fromLineSplit[1], dm.SemverComponent)[0]
-	newFromLine := fmt.Sprintf("%s:%s", fromLineSplit[0], newVersion)
-	dockerFile[idx] = newFromLine
+// dockerFilePath returns the path of the Dockerfile an image is built from
+func (dm *DependencyMap) dockerFilePath(folder string) string {
+	return fmt.Sprintf("%s/%s/%s", dm.BasePath, dm.DockerImages[folder].Folder, dm.DockerImages[folder].Config.Dockerfile)
+}
 
-	newContent := []byte(strings.Join(dockerFile, "\n"))
-	file := fmt.Sprintf("%s/%s/Dockerfile", dm.BasePath, folder)
-	if dryRun {
-		log.Info(fmt.Sprintf("would update %s FROM line to '%s'", file, newFromLine))
-	} else {
-		err := ioutil.WriteFile(file, newContent, 0644)
+func (dm *DependencyMap) writeDockerFile(folder string) {
+	newContent := dm.DockerImages[folder].DockerFile.Bytes()
+	file := dm.dockerFilePath(folder)
+	if !dryRun {
+		err := writeFileAtomic(file, newContent)
 		if err != nil {
 			log.Fatalf("couldn't write %s to file %s", newContent, file)
 		}
 	}
 }
 
-func (dm *DependencyMap) updateVersions(images []string, increment bool) {
-	for _, image := range images {
-		dm.updateVersionFile(image)
-		if increment {
-			dm.updateDockerFile(image)
-		}
-		var dependentImages []string
-		for key, dockerImage := range dm.DockerImages {
-			if dockerImage.FromImage == dm.DockerImages[image].Image {
-				dependentImages = append(dependentImages, key)
+// pinDigests rewrites every FROM line of folder that references a pushed image to tag@digest
+func (dm *DependencyMap) pinDigests(folder string) {
+	dockerImage := dm.DockerImages[folder]
+	pinned := false
+	for _, stage := range dockerImage.Stages {
+		for parentFolder, parent := range dm.DockerImages {
+			digest := dm.State.Digest(parentFolder)
+			if digest == "" || !stage.isFrom(parent.Image) {
+				continue
 			}
+			ref := dockerfile.ParseReference(dockerImage.DockerFile.Value(stage.Image))
+			ref.Digest = digest
+			dockerImage.DockerFile.Replace(stage.Image, ref.String())
+			log.Infof("pinned FROM line %d of %s to %s", stage.Line, folder, ref.String())
+			pinned = true
 		}
-		if len(dependentImages) > 0 {
-			dm.updateVersions(dependentImages, true)
+	}
+	if pinned {
+		dm.writeDockerFile(folder)
+	}
+}
+
+// globalArg returns the last declaration of an ARG before the first FROM
+func (di *DockerImage) globalArg(name string) (dockerfile.Arg, bool) {
+	var globalArg dockerfile.Arg
+	found := false
+	for _, arg := range di.DockerFile.Args() {
+		if arg.Global && arg.Name == name {
+			globalArg = arg
+			found = true
 		}
 	}
+	return globalArg, found
 }
-func (dm *DependencyMap) buildDockerImages(images []string) {
-	var wg sync.WaitGroup
-	for _, folder := range images {
-		wg.Add(1)
-		go func(folder string, dm DependencyMap, wg *sync.WaitGroup) {
-			err := dm.buildDockerImage(folder)
-			if err != nil {
-				wg.Done()
-				return
-			}
-			var dependentImages []string
-			for key, dockerImage := range dm.DockerImages {
-				log.Debugf("Comparing %s to %s\n", dm.DockerImages[folder].FromImage, dm.DockerImages[folder].Image)
-				if dockerImage.FromImage == dm.DockerImages[folder].Image {
-					dependentImages = append(dependentImages, key)
-				}
+
+// updateVersions bumps the VERSION of every image in images and every image built from them along with
+// the FROM lines that reference them.  The files are replaced together so a failure part way leaves the
+// tree as it was.
+func (dm *DependencyMap) updateVersions(images []string) {
+	plan := dm.planBump(images)
+	if dryRun {
+		plan.logChanges()
+		return
+	}
+	if err := plan.apply(); err != nil {
+		log.Fatalf("couldn't update versions: %v", err)
+	}
+}
+
+// planBump works out and checks every change bumping images makes without writing anything
+func (dm *DependencyMap) planBump(images []string) *BumpPlan {
+	root, err := filepath.Abs(dm.BasePath)
+	if err != nil {
+		log.Fatalf("nothing has been written: %v", err)
+	}
+	plan := newBumpPlan(root)
+	if err := dm.planVersions(plan, images); err != nil {
+		log.Fatalf("nothing has been written: %v", err)
+	}
+	if err := plan.finish(); err != nil {
+		log.Fatalf("nothing has been written: %v", err)
+	}
+	if err := plan.validate(); err != nil {
+		log.Fatalf("nothing has been written: %v", err)
+	}
+	return plan
+}
+
+// planVersions adds the new VERSION of every image imagesToBuild gives for images to plan, along with
+// the FROM lines that reference them.  Each image is bumped by the component bumpComponentOf gives
+// and each FROM line by the component its image was bumped by.
+func (dm *DependencyMap) planVersions(plan *BumpPlan, images []string) error {
+	for _, image := range dm.imagesToBuild(images) {
+		if dm.keepsVersion(image) {
+			continue
+		}
+		if err := dm.planVersionFile(plan, image); err != nil {
+			return err
+		}
+		for _, child := range dm.getDependents(image) {
+			// The FROM lines of an image left as it is still match the image it was pushed as
+			if dm.keepsVersion(child) {
+				continue
 			}
-			if len(dependentImages) > 0 {
-				dm.buildDockerImages(dependentImages)
+			if err := dm.planDockerFile(plan, child, image); err != nil {
+				return err
 			}
-			wg.Done()
-		}(folder, *dm, &wg)
+		}
+	}
+	return nil
+}
+
+// onRetry reports a retry of a phase of the build of folder in its docker logs, the logs and the gui
+func (dm *DependencyMap) onRetry(folder string, phase string, policy RetryPolicy) func(int, error, time.Duration) {
+	return func(attempt int, err error, wait time.Duration) {
+		dm.State.AddRetry(folder)
+		fmt.Fprintf(dm.State.Logs(folder), "\n%s failed with %v, retrying in %s (attempt %d of %d)\n", phase, err, wait, attempt+1, policy.Attempts)
+		log.Warnf("%s for %s failed with %v, retrying in %s (attempt %d of %d)", phase, folder, err, wait, attempt+1, policy.Attempts)
 	}
-	wg.Wait()
 }
 
-func (dm *DependencyMap) buildDockerImage(folder string) error {
-	newVersion := bumpVersion(dm.DockerImages[folder].Version, dm.SemverComponent)
-	newVersion = append(newVersion, "latest")
-	image := fmt.Sprintf("%s/%s", dm.Registry, folder)
+// cancelled records an image as cancelled if ctx is done, returning why
+func (dm *DependencyMap) cancelled(ctx context.Context, folder string, err error) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	dm.State.SetFinished(folder, StatusCancelled, exitCode(err), context.Cause(ctx).Error())
+	log.Warnf("cancelled %s: %v", folder, context.Cause(ctx))
+	return context.Cause(ctx)
+}
+
+// interrupted records why a command for folder was stopped early, returning nil if it wasn't.
+// The whole build being cancelled marks the image cancelled but the image running out of time is a failure.
+func (dm *DependencyMap) interrupted(buildCtx context.Context, ctx context.Context, folder string, err error) error {
+	if cancelErr := dm.cancelled(buildCtx, folder, err); cancelErr != nil {
+		return cancelErr
+	}
+	if ctx.Err() == nil {
+		return nil
+	}
+	dm.State.SetFinished(folder, StatusFailure, exitCode(err), context.Cause(ctx).Error())
+	log.Errorf("%v", context.Cause(ctx))
+	return context.Cause(ctx)
+}
+
+func (dm *DependencyMap) buildDockerImage(buildCtx context.Context, folder string) error {
+	ctx := buildCtx
+	if timeout := dm.DockerImages[folder].Config.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(buildCtx, timeout, fmt.Errorf("%s timed out after %s", folder, timeout))
+		defer cancel()
+	}
+
+	if dm.keepsVersion(folder) {
+		// Rebuilding it would push over the tag it was already pushed with
+		version := dm.DockerImages[folder].Version
+		dm.State.SetFinished(folder, StatusSkipped, 0, fmt.Sprintf("%s stays at %s", folder, version))
+		log.Infof("not building %s as it stays at %s", folder, version)
+		return nil
+	}
+	version, err := dm.nextVersion(dm.DockerImages[folder].Version, dm.bumpComponentOf(folder))
+	if err != nil {
+		dm.State.SetFinished(folder, StatusFailure, 0, "invalid version")
+		log.Errorf("couldn't work out the version of %s: %v", folder, err)
+		return err
+	}
+
+	if pinDigests {
+		dm.pinDigests(folder)
+	}
+	config := dm.DockerImages[folder].Config
+	if dm.PreRelease != "" {
+		// Only the pre-release itself is pushed so nothing else moves
+		noFloatingTags := false
+		config.PreReleaseFloatingTags = &noFloatingTags
+	}
+	newVersion, err := imageTags(version, config)
+	if err != nil {
+		dm.State.SetFinished(folder, StatusFailure, 0, "invalid tags")
+		log.Errorf("couldn't work out the tags of %s: %v", folder, err)
+		return err
+	}
+	image := fmt.Sprintf("%s/%s", dm.Registry, dm.DockerImages[folder].Name)
 	tags := []string{}
 	for _, tag := range newVersion {
 		tags = append(tags, fmt.Sprintf("%s:%s", image, tag))
 	}
 
-	command := "docker"
-	args := []string{"build"}
-	if push {
-		args = append(args, "--pull")
+	path := filepath.Join(dm.BasePath, dm.DockerImages[folder].Folder, config.Context)
+	opts := BuildOptions{
+		Context:   path,
+		Tags:      tags[:1],
+		BuildArgs: dm.DockerImages[folder].BuildArgs,
+		Target:    config.Target,
+		Labels:    dm.DockerImages[folder].Labels,
+		Secrets:   config.Secrets,
+		SSH:       config.SSH,
+		Pull:      push,
+		NoCache:   noCache,
 	}
-	if noCache {
-		args = append(args, "--no-cache")
+	if config.Dockerfile != DefaultDockerfile || config.Context != DefaultContext {
+		opts.Dockerfile = dm.dockerFilePath(folder)
 	}
-
-	for _, tag := range tags {
-		args = append(args, "-t", tag)
+	if platforms := dm.DockerImages[folder].Config.Platforms; len(platforms) > 0 {
+		opts.Tags = tags
+		opts.Platforms = platforms
+		return dm.buildMultiPlatformImage(buildCtx, ctx, folder, opts)
 	}
-	path := fmt.Sprintf("%s/%s", dm.BasePath, folder)
-	args = append(args, path)
-
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = dm.DockerImages[folder].Logs
-	cmd.Stderr = dm.DockerImages[folder].Logs
 
+	var buildOutput bytes.Buffer
+	cached := false
 	if dryRun {
 		log.Info(fmt.Sprintf("would build %s with tags %v", folder, newVersion))
 	} else {
 		log.Infof("building %s", folder)
-		dm.DockerImages[folder].BuildStatus = "building"
-		err := cmd.Run()
+		dm.State.SetStatus(folder, StatusBuilding)
+		err := dm.BuildRetry.do(ctx, func(output io.Writer) error {
+			buildOutput.Reset()
+			return dm.Builder.Build(ctx, opts, io.MultiWriter(dm.State.Logs(folder), &buildOutput, output))
+		}, dm.onRetry(folder, "build", dm.BuildRetry))
+		if err == nil {
+			for _, tag := range tags[1:] {
+				if err = dm.Builder.Tag(ctx, tags[0], tag, dm.State.Logs(folder)); err != nil {
+					break
+				}
+			}
+		}
 		if err != nil {
 			if nonInteractive {
-				log.Infof("output of docker build %s\n%s", folder, dm.DockerImages[folder].Logs.String())
+				log.Infof("output of build %s\n%s", folder, dm.State.LogString(folder))
 			}
-			dm.DockerImages[folder].BuildStatus = "failure"
-			log.Errorf("build failed for %s with err:\n%v", path, err)
+			if cancelErr := dm.interrupted(buildCtx, ctx, folder, err); cancelErr != nil {
+				return cancelErr
+			}
+			dm.State.SetFinished(folder, StatusFailure, exitCode(err), "build failed")
+			log.Errorf("build failed for %s with err:\n%v", folder, err)
 			return err
 		} else {
 			if nonInteractive {
-				log.Infof("output of docker build %s\n%s", folder, dm.DockerImages[folder].Logs.String())
+				log.Infof("output of build %s\n%s", folder, dm.State.LogString(folder))
 			}
-			log.Infof("build succeeded for %s", path)
+			cached = buildWasCached(buildOutput.String())
+			log.Infof("build succeeded for %s", folder)
 		}
 	}
-	if push {
-		dm.DockerImages[folder].BuildStatus = "pushing"
+	if push && config.SkipPush {
+		log.Infof("not pushing %s as skipPush is set", folder)
+	}
+	if push && !config.SkipPush {
+		dm.State.SetStatus(folder, StatusPushing)
 		for _, tag := range tags {
 			if dryRun {
 				log.Warnf("would push %s", tag)
 			} else {
-				command := "docker"
-				args := []string{"push", tag}
-				cmd := exec.Command(command, args...)
-				cmd.Stdout = dm.DockerImages[folder].Logs
-				cmd.Stderr = dm.DockerImages[folder].Logs
-				err := cmd.Run()
+				err := dm.PushRetry.do(ctx, func(output io.Writer) error {
+					return dm.Builder.Push(ctx, tag, io.MultiWriter(dm.State.Logs(folder), output))
+				}, dm.onRetry(folder, fmt.Sprintf("push %s", tag), dm.PushRetry))
 				if err != nil {
-					dm.DockerImages[folder].BuildStatus = "failure"
+					if cancelErr := dm.interrupted(buildCtx, ctx, folder, err); cancelErr != nil {
+						return cancelErr
+					}
+					dm.State.SetFinished(folder, StatusFailure, exitCode(err), fmt.Sprintf("push %s failed", tag))
 					if nonInteractive {
-						log.Infof("output of docker push %s\n%s", tag, dm.DockerImages[folder].Logs.String())
+						log.Infof("output of push %s\n%s", tag, dm.State.LogString(folder))
 					}
 					log.Errorf("push failed for %s with err:\n%s", tag, err)
 					return err
 				}
 				if nonInteractive {
-					log.Infof("output of docker push %s\n%s", tag, dm.DockerImages[folder].Logs.String())
+					log.Infof("output of push %s\n%s", tag, dm.State.LogString(folder))
+				}
+			}
+		}
+		if pinDigests {
+			if dryRun {
+				log.Warnf("would pin images built from %s to its digest", tags[0])
+			} else {
+				digest, err := dm.Builder.Inspect(ctx, tags[0])
+				if err != nil {
+					if cancelErr := dm.interrupted(buildCtx, ctx, folder, err); cancelErr != nil {
+						return cancelErr
+					}
+					dm.State.SetFinished(folder, StatusFailure, exitCode(err), fmt.Sprintf("couldn't get digest of %s", tags[0]))
+					log.Errorf("couldn't get digest of %s with err:\n%s", tags[0], err)
+					return err
 				}
+				log.Infof("%s pushed with digest %s", tags[0], digest)
+				dm.State.SetDigest(folder, digest)
 			}
 		}
 	}
-	dm.DockerImages[folder].BuildStatus = "success"
+	if cached {
+		dm.State.SetStatus(folder, StatusCached)
+	} else {
+		dm.State.SetStatus(folder, StatusSuccess)
+	}
 	return nil
 }
 
-func generateDockerImagesMap(path string, registry string) DockerImages {
+var (
+	buildKitStepRegex = regexp.MustCompile(`(?m)^#(\d+) \[[^\]]*\d+/\d+\] (\S+)`)
+)
+
+// buildWasCached reports whether every step of a build came from the cache.
+// The classic builder prints "Running in" for every step it runs and BuildKit prints "#<step> CACHED" for every
+// step it doesn't, apart from FROM which is always resolved.
+func buildWasCached(output string) bool {
+	if strings.Contains(output, "---> Using cache") {
+		return !strings.Contains(output, "---> Running in")
+	}
+	steps := buildKitStepRegex.FindAllStringSubmatch(output, -1)
+	if len(steps) == 0 {
+		return false
+	}
+	for _, step := range steps {
+		if strings.EqualFold(step[2], "FROM") {
+			continue
+		}
+		if !strings.Contains(output, fmt.Sprintf("\n#%s CACHED", step[1])) {
+			return false
+		}
+	}
+	return true
+}
+
+// exitCode returns the exit code of a failed command or -1 if it never exited
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+func generateDockerImagesMap(path string, registry string, repositoryNaming string, defaults ImageConfig, configs map[string]ImageConfig, overrides ImageConfig) DockerImages {
 	di := make(DockerImages)
-	dirs, err := ioutil.ReadDir(path)
+	err := filepath.Walk(path, func(dirPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if dirPath != path && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		relPath, err := filepath.Rel(path, dirPath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		dirName := filepath.ToSlash(relPath)
+		log.Debugf("processing %s", dirName)
+
+		config := imageConfig(dirName, defaults, configs).merge(loadImageFile(dirPath))
+		if dockerImage, ok := newDockerImage(path, dirName, repositoryName(dirName, repositoryNaming), registry, config.merge(overrides)); ok {
+			di[dirName] = dockerImage
+		}
+		variants := make([]string, 0, len(config.Variants))
+		for variant := range config.Variants {
+			variants = append(variants, variant)
+		}
+		sort.Strings(variants)
+		for _, variant := range variants {
+			variantConfig := config.merge(config.Variants[variant]).merge(overrides)
+			name := fmt.Sprintf("%s-%s", repositoryName(dirName, repositoryNaming), variant)
+			dockerImage, ok := newDockerImage(path, dirName, name, registry, variantConfig)
+			if !ok {
+				log.Fatalf("no %s in %s for variant %s", variantConfig.Dockerfile, dirName, variant)
+			}
+			di[fmt.Sprintf("%s:%s", dirName, variant)] = dockerImage
+		}
+		return nil
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, dir := range dirs {
-		dirName := dir.Name()
-		log.Debugf("processing %s", dirName)
+	return di
+}
 
-		dockerImage := DockerImage{}
+// newDockerImage reads the Dockerfile and VERSION of an image in folder dirName.  It returns false if there is no Dockerfile.
+func newDockerImage(path string, dirName string, name string, registry string, config ImageConfig) (*DockerImage, bool) {
+	dockerImage := DockerImage{Config: config}
+	dockerImage.BuildArgs = parseBuildArgs(dockerImage.Config.BuildArgs)
+	dockerImage.Labels = parseKeyValues("label", dockerImage.Config.Labels)
 
-		dockerFile, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/Dockerfile", path, dirName))
-		if err != nil {
-			continue
+	dockerFilePath := fmt.Sprintf("%s/%s/%s", path, dirName, dockerImage.Config.Dockerfile)
+	dockerFile, err := ioutil.ReadFile(dockerFilePath)
+	if err != nil {
+		return nil, false
+	}
+	parsedDockerFile, err := dockerfile.Parse(dockerFile)
+	if err != nil {
+		log.Fatalf("couldn't parse %s: %v", dockerFilePath, err)
+	}
+	globalArgs := parsedDockerFile.GlobalArgs()
+	for _, arg := range parsedDockerFile.Args() {
+		if value, ok := dockerImage.BuildArgs[arg.Name]; ok && arg.Global {
+			globalArgs[arg.Name] = value
 		}
-		dockerFileLines := strings.Split(string(dockerFile), "\n")
-		for idx, line := range dockerFileLines {
-			if strings.HasPrefix(line, "FROM") {
-				dockerImage.FromImage = strings.Replace(line, "FROM ", "", 1)
-				dockerImage.DockerFileFromLine = idx
-				break
-			}
+	}
+	var aliases []string
+	for _, from := range parsedDockerFile.Froms() {
+		stage := Stage{
+			FromImage: dockerfile.Expand(from.Image.Value, globalArgs),
+			Alias:     from.Alias,
+			Line:      from.Instruction.Line,
+			Image:     from.Image,
 		}
-		dockerImage.DockerFile = dockerFileLines
+		if stringInSlice(stage.FromImage, aliases) {
+			log.Debugf("%s stage on line %d is built from stage %s", dirName, stage.Line, stage.FromImage)
+		}
+		if stage.Alias != "" {
+			aliases = append(aliases, stage.Alias)
+		}
+		dockerImage.Stages = append(dockerImage.Stages, stage)
+	}
+	dockerImage.DockerFile = parsedDockerFile
 
-		versionFile, _ := ioutil.ReadFile(fmt.Sprintf("%s/%s/VERSION", path, dirName))
-		versionFileLines := strings.Split(string(versionFile), "\n")
-		dockerImage.Version = strings.Replace(versionFileLines[0], "\n", "", 1)
-		dockerImage.Image = fmt.Sprintf("%s/%s:%s", registry, dirName, dockerImage.Version)
-		dockerImage.Name = dirName
-		var buf bytes.Buffer
-		dockerImage.Logs = &buf
+	versionFile, _ := ioutil.ReadFile(fmt.Sprintf("%s/%s/VERSION", path, dirName))
+	versionFileLines := strings.Split(string(versionFile), "\n")
+	dockerImage.Version = strings.Replace(versionFileLines[0], "\n", "", 1)
+	dockerImage.Name = name
+	dockerImage.Image = fmt.Sprintf("%s/%s:%s", registry, dockerImage.Name, versionTag(dockerImage.Version))
+	dockerImage.Folder = dirName
+
+	return &dockerImage, true
+}
 
-		di[dirName] = &dockerImage
+// repositoryName derives the docker repository name of an image from its folder relative to the root folder
+func repositoryName(folder string, repositoryNaming string) string {
+	switch repositoryNaming {
+	case RepositoryNamingBase:
+		return filepath.Base(folder)
+	case RepositoryNamingDashed:
+		return strings.Replace(folder, "/", "-", -1)
+	default:
+		return folder
 	}
-	return di
 }
 
 func gui(dm *DependencyMap) {
@@ -608,7 +1489,7 @@ func (dm *DependencyMap) layout(g *gocui.Gui) error {
 		}
 	}
 	if v, err := g.SetView("controls", -1, maxY-2, maxX, maxY); err != nil {
-		fmt.Fprintln(v, "\u001b[37;1m[Ctrl-C]\u001b[0m Quit  \u001b[37;1m[Up/Down]\u001b[0m Select image  \u001b[33mBuilding\u001b[0m  \u001b[36mPushing\u001b[0m  \u001b[31mFailed\u001b[0m  \u001b[32mDone\u001b[0m")
+		fmt.Fprintln(v, "\u001b[37;1m[Ctrl-C]\u001b[0m Quit  \u001b[37;1m[Up/Down]\u001b[0m Select image  \u001b[2mQueued\u001b[0m  \u001b[33mBuilding\u001b[0m  \u001b[36mPushing\u001b[0m  \u001b[31mFailed\u001b[0m  \u001b[35mSkipped/Cancelled\u001b[0m  \u001b[32mDone\u001b[0m")
 	}
 	return nil
 }
@@ -620,27 +1501,29 @@ func (dm *DependencyMap) logsView(g *gocui.Gui) error {
 	return nil
 }
 
-func (dm *DependencyMap) dockerLogView(g *gocui.Gui) error {
-	v, _ := g.View("images")
+// cursorImage returns the image on the line of the images view the cursor is on
+func (dm *DependencyMap) cursorImage(v *gocui.View) string {
+	_, oy := v.Origin()
 	_, cy := v.Cursor()
-	line, _ := v.Line(cy)
-
-	reg, err := regexp.Compile("[^a-zA-Z0-9-]+")
-	if err != nil {
-		log.Fatal(err)
+	if oy+cy < len(dm.guiImages) {
+		return dm.guiImages[oy+cy]
 	}
-	image := reg.ReplaceAllString(strings.TrimSpace(line), "")
+	return ""
+}
+
+func (dm *DependencyMap) dockerLogView(g *gocui.Gui) error {
+	v, _ := g.View("images")
+	image := dm.cursorImage(v)
 
 	v, _ = g.View("dockerLogs")
-	dockerImage, ok := dm.DockerImages[image]
-	if ok {
+	if _, ok := dm.DockerImages[image]; ok {
 		v.Clear()
-		err = v.SetOrigin(0, 0)
+		err := v.SetOrigin(0, 0)
 		if err != nil {
 			log.Error(err)
 		}
 
-		logs := dockerImage.Logs.String()
+		logs := dm.State.LogString(image)
 		regex, _ := regexp.Compile("\r\n")
 		logs = regex.ReplaceAllString(logs, "\n")
 		regex, _ = regexp.Compile("\r")
@@ -652,24 +1535,18 @@ func (dm *DependencyMap) dockerLogView(g *gocui.Gui) error {
 
 func (dm *DependencyMap) imagesView(g *gocui.Gui) error {
 	v, _ := g.View("images")
-	_, cy := v.Cursor()
-	line, _ := v.Line(cy)
-
-	reg, err := regexp.Compile("[^a-zA-Z0-9-]+")
-	if err != nil {
-		log.Fatal(err)
-	}
-	image := reg.ReplaceAllString(strings.TrimSpace(line), "")
-	cursorDockerImage, ok := dm.DockerImages[image]
-	if ok {
-		switch buildStatus := cursorDockerImage.BuildStatus; buildStatus {
-		case "building":
+	image := dm.cursorImage(v)
+	if _, ok := dm.DockerImages[image]; ok {
+		switch buildStatus := dm.State.Status(image); buildStatus {
+		case StatusBuilding:
 			v.SelFgColor = gocui.ColorYellow | gocui.AttrBold
-		case "pushing":
+		case StatusPushing:
 			v.SelFgColor = gocui.ColorBlue | gocui.AttrBold
-		case "failure":
+		case StatusFailure:
 			v.SelFgColor = gocui.ColorRed | gocui.AttrBold
-		case "success":
+		case StatusSkipped, StatusCancelled:
+			v.SelFgColor = gocui.ColorMagenta | gocui.AttrBold
+		case StatusSuccess, StatusCached:
 			v.SelFgColor = gocui.ColorGreen | gocui.AttrBold
 		default:
 			v.SelFgColor = gocui.AttrBold
@@ -677,41 +1554,49 @@ func (dm *DependencyMap) imagesView(g *gocui.Gui) error {
 	}
 
 	v.Clear()
+	dm.guiImages = []string{}
 	for _, image := range dm.RootImages {
 		dm.printImage(v, image, "")
-		dm.printDependencies(v, dm.DockerImages[image].Image, "  ↳ ")
+		dm.printDependencies(v, image, "  ↳ ")
 	}
 	return nil
 }
 
-func (dm *DependencyMap) printDependencies(v *gocui.View, baseImage string, prefix string) {
-	keys := make([]string, 0, len(dm.DockerImages))
-	for key := range dm.DockerImages {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-	for _, key := range keys {
-		if dm.DockerImages[key].FromImage == baseImage {
-			dm.printImage(v, key, prefix)
-			dm.printDependencies(v, dm.DockerImages[key].Image, fmt.Sprintf("  %s", prefix))
-		}
+func (dm *DependencyMap) printDependencies(v *gocui.View, parent string, prefix string) {
+	for _, key := range dm.getDependents(parent) {
+		dm.printImage(v, key, prefix)
+		dm.printDependencies(v, key, fmt.Sprintf("  %s", prefix))
 	}
 }
 
 func (dm *DependencyMap) printImage(v *gocui.View, image string, prefix string) {
-	dockerImage, ok := dm.DockerImages[image]
-	if ok {
-		switch buildStatus := dockerImage.BuildStatus; buildStatus {
-		case "building":
-			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[33m%s\u001b[0m", prefix, dm.DockerImages[image].Name))
-		case "pushing":
-			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[36m%s\u001b[0m", prefix, dm.DockerImages[image].Name))
-		case "failure":
-			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[31m%s\u001b[0m", prefix, dm.DockerImages[image].Name))
-		case "success":
-			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[32m%s\u001b[0m", prefix, dm.DockerImages[image].Name))
+	if _, ok := dm.DockerImages[image]; ok {
+		dm.guiImages = append(dm.guiImages, image)
+		retries := ""
+		if result := dm.State.Result(image); result.Retries > 0 {
+			retries = fmt.Sprintf(" (retry %d)", result.Retries)
+		}
+		switch buildStatus := dm.State.Status(image); buildStatus {
+		case StatusQueued:
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[2m%s\u001b[0m", prefix, image))
+		case StatusBuilding:
+			progress := ""
+			if platforms := dm.DockerImages[image].Config.Platforms; len(platforms) > 0 {
+				progress = fmt.Sprintf(" [%s]", strings.Join(platformProgress(dm.State.LogString(image), platforms), ", "))
+			}
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[33m%s%s%s\u001b[0m", prefix, image, progress, retries))
+		case StatusPushing:
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[36m%s%s\u001b[0m", prefix, image, retries))
+		case StatusFailure:
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[31m%s\u001b[0m", prefix, image))
+		case StatusSkipped, StatusCancelled:
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[35m%s (%s)\u001b[0m", prefix, image, buildStatus))
+		case StatusSuccess:
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[32m%s\u001b[0m", prefix, image))
+		case StatusCached:
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[32m%s (cached)\u001b[0m", prefix, image))
 		default:
-			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[0m%s", prefix, dm.DockerImages[image].Name))
+			fmt.Fprintln(v, fmt.Sprintf("%s\u001b[0m%s", prefix, image))
 		}
 	}
 }
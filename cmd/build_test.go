@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveBumpComponents(t *testing.T) {
+	images := map[string][]string{
+		"a": nil,
+		"b": {"a"},
+		"c": {"b"},
+		"d": {"a"},
+		"e": {"d"},
+		"f": {"c", "e"},
+	}
+	tests := []struct {
+		name      string
+		bump      string
+		propagate map[string]string
+		want      map[string]string
+	}{
+		{
+			name: "same",
+			bump: VersionMajor,
+			want: map[string]string{"a": "major", "b": "major", "c": "major", "d": "major", "e": "major", "f": "major"},
+		},
+		{
+			name:      "same as a propagated parent",
+			bump:      VersionMajor,
+			propagate: map[string]string{"b": VersionPatch, "d": VersionMinor},
+			want:      map[string]string{"a": "major", "b": "patch", "c": "patch", "d": "minor", "e": "minor", "f": "minor"},
+		},
+		{
+			name:      "nothing bumped below none",
+			bump:      VersionMajor,
+			propagate: map[string]string{"b": VersionNone, "c": VersionPatch},
+			want:      map[string]string{"a": "major", "b": "none", "c": "none", "d": "major", "e": "major", "f": "major"},
+		},
+		{
+			name:      "release that leaves the version as it is",
+			bump:      VersionMajor,
+			propagate: map[string]string{"b": VersionRelease, "c": VersionPatch},
+			want:      map[string]string{"a": "major", "b": "none", "c": "none", "d": "major", "e": "major", "f": "major"},
+		},
+		{
+			name:      "bump none",
+			bump:      VersionNone,
+			propagate: map[string]string{"b": VersionPatch},
+			want:      map[string]string{"a": "none", "b": "none", "c": "none", "d": "none", "e": "none", "f": "none"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dm := newTestDependencyMap(images, &fakeBuilder{}, 0)
+			dm.SemverComponent = test.bump
+			for folder, propagate := range test.propagate {
+				dm.DockerImages[folder].Config.Propagate = propagate
+			}
+			if got := dm.resolveBumpComponents([]string{"a"}); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("resolveBumpComponents() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveBumpComponentsVariants(t *testing.T) {
+	images := map[string][]string{
+		"a":      nil,
+		"b":      {"a"},
+		"b:slim": nil,
+		"c":      {"b:slim"},
+		"d":      nil,
+	}
+	dm := newTestDependencyMap(images, &fakeBuilder{}, 0)
+	dm.DockerImages["b:slim"].Folder = "b"
+	dm.SemverComponent = VersionMinor
+	dm.DockerImages["b"].Config.Propagate = VersionPatch
+
+	want := map[string]string{"a": "minor", "b": "patch", "b:slim": "patch", "c": "patch"}
+	if got := dm.resolveBumpComponents([]string{"a"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveBumpComponents() = %v, want %v", got, want)
+	}
+	if got, want := dm.imagesToBuild([]string{"a"}), []string{"a", "b", "b:slim", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("imagesToBuild() = %v, want %v", got, want)
+	}
+}
+
+func TestBumpVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		component string
+		preID     string
+		want      string
+	}{
+		{"1.2.3", VersionNone, "", "1.2.3"},
+		{"1.2.3", VersionPatch, "", "1.2.4"},
+		{"1.2.3", VersionMinor, "", "1.3.0"},
+		{"1.2.3", VersionMajor, "", "2.0.0"},
+		{"1.2.3-1", VersionPatch, "", "1.2.4-1"},
+		{"1.2.3+build.5", VersionPatch, "", "1.2.4"},
+		{"1.2.4-rc.4", VersionRelease, "", "1.2.4"},
+		{"1.2.3", VersionRelease, "", "1.2.3"},
+		{"1.2.3", VersionPre, "", "1.2.4-0"},
+		{"1.2.3", VersionPre, "rc", "1.2.4-rc.0"},
+		{"1.2.4-rc.3", VersionPre, "", "1.2.4-rc.4"},
+		{"1.2.4-rc.3", VersionPre, "rc", "1.2.4-rc.4"},
+		{"1.2.4-beta.2", VersionPre, "rc", "1.2.4-rc.0"},
+		{"1.2.4-beta.2", VersionPre, "alpha", "1.2.5-alpha.0"},
+		{"1.2.4-rc", VersionPre, "", "1.2.4-rc.0"},
+		{"1.2.4-rc.1.beta", VersionPre, "", "1.2.4-rc.2.beta"},
+		{"1.2.4-rc.0", VersionPre, "1", "1.2.5-1.0"},
+		{"stable", VersionPatch, "", "stable"},
+	}
+	for _, test := range tests {
+		got, err := bumpVersion(test.version, test.component, test.preID)
+		if err != nil {
+			t.Errorf("bumpVersion(%q, %q, %q) error = %v", test.version, test.component, test.preID, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("bumpVersion(%q, %q, %q) = %q, want %q", test.version, test.component, test.preID, got, test.want)
+		}
+	}
+	if _, err := bumpVersion("1.2.3", "huge", ""); err == nil {
+		t.Error("bumpVersion() with an unknown component succeeded, want an error")
+	}
+}
+
+func TestNextPreRelease(t *testing.T) {
+	tests := []struct {
+		preRelease string
+		preID      string
+		want       string
+	}{
+		{"", "", "0"},
+		{"", "rc", "rc.0"},
+		{"rc.3", "", "rc.4"},
+		{"rc.3", "rc", "rc.4"},
+		{"beta.2", "rc", "rc.0"},
+		{"rc", "", "rc.0"},
+		{"7", "", "8"},
+		{"rc.1.beta", "", "rc.2.beta"},
+	}
+	for _, test := range tests {
+		if got := nextPreRelease(test.preRelease, test.preID); got != test.want {
+			t.Errorf("nextPreRelease(%q, %q) = %q, want %q", test.preRelease, test.preID, got, test.want)
+		}
+	}
+}
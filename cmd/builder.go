@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lhopki01/docker-chain-builder/dockerfile"
+)
+
+const (
+	BuilderDocker  = "docker"
+	BuilderBuildx  = "buildx"
+	BuilderPodman  = "podman"
+	BuilderBuildah = "buildah"
+)
+
+var (
+	Builders = []string{
+		BuilderDocker,
+		BuilderBuildx,
+		BuilderPodman,
+		BuilderBuildah,
+	}
+)
+
+// BuildOptions describes a single image build
+type BuildOptions struct {
+	Context    string
+	Dockerfile string
+	Tags       []string
+	BuildArgs  map[string]string
+	Target     string
+	Labels     map[string]string
+	Secrets    []string
+	SSH        []string
+	Platforms  []string
+	Pull       bool
+	NoCache    bool
+}
+
+// Builder runs the commands that build, tag, push and inspect images.
+// Commands must stop when ctx is done and write their output to out.
+type Builder interface {
+	Build(ctx context.Context, opts BuildOptions, out io.Writer) error
+	Tag(ctx context.Context, source string, target string, out io.Writer) error
+	Push(ctx context.Context, tag string, out io.Writer) error
+	// Inspect returns the digest of a pushed tag
+	Inspect(ctx context.Context, tag string) (string, error)
+}
+
+// MultiPlatformBuilder is a Builder that can build an image for several platforms at once.
+// The images can't be loaded locally so they are pushed as a manifest list as part of the build.
+type MultiPlatformBuilder interface {
+	Builder
+	BuildAndPush(ctx context.Context, opts BuildOptions, out io.Writer) error
+	// InspectManifest returns the digest of a pushed manifest list
+	InspectManifest(ctx context.Context, tag string) (string, error)
+}
+
+// newBuilder returns the Builder called name
+func newBuilder(name string) (Builder, error) {
+	switch name {
+	case BuilderDocker:
+		return &dockerBuilder{cliBuilder{command: "docker", build: []string{"build"}}}, nil
+	case BuilderBuildx:
+		return &dockerBuilder{cliBuilder{command: "docker", build: []string{"buildx", "build", "--load"}}}, nil
+	case BuilderPodman:
+		return &cliBuilder{command: "podman", build: []string{"build"}}, nil
+	case BuilderBuildah:
+		return &buildahBuilder{digests: make(map[string]string)}, nil
+	}
+	return nil, fmt.Errorf("%s invalid builder; choose from %v", name, Builders)
+}
+
+// newCommand creates a command that is interrupted when ctx is done and killed if it hasn't exited shortly after
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
+
+func runCommand(ctx context.Context, out io.Writer, name string, args ...string) error {
+	cmd := newCommand(ctx, name, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+// buildFlags are the flags for the options every builder understands
+func buildFlags(opts BuildOptions) []string {
+	var args []string
+	if opts.Pull {
+		args = append(args, "--pull")
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+
+	if opts.Dockerfile != "" {
+		args = append(args, "-f", opts.Dockerfile)
+	}
+	if opts.Target != "" {
+		args = append(args, "--target", opts.Target)
+	}
+	args = append(args, keyValueFlags("--build-arg", opts.BuildArgs)...)
+	args = append(args, keyValueFlags("--label", opts.Labels)...)
+	for _, secret := range opts.Secrets {
+		args = append(args, "--secret", secret)
+	}
+	for _, ssh := range opts.SSH {
+		args = append(args, "--ssh", ssh)
+	}
+
+	for _, tag := range opts.Tags {
+		args = append(args, "-t", tag)
+	}
+	return args
+}
+
+// keyValueFlags returns flag KEY=VALUE for every entry of keyValues sorted by key
+func keyValueFlags(flag string, keyValues map[string]string) []string {
+	keys := make([]string, 0, len(keyValues))
+	for key := range keyValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, key := range keys {
+		args = append(args, flag, fmt.Sprintf("%s=%s", key, keyValues[key]))
+	}
+	return args
+}
+
+// cliBuilder drives the docker CLI, docker buildx or podman which all share the same commands
+type cliBuilder struct {
+	command string
+	build   []string
+}
+
+func (b *cliBuilder) Build(ctx context.Context, opts BuildOptions, out io.Writer) error {
+	args := append(append([]string{}, b.build...), buildFlags(opts)...)
+	args = append(args, opts.Context)
+	return runCommand(ctx, out, b.command, args...)
+}
+
+func (b *cliBuilder) Tag(ctx context.Context, source string, target string, out io.Writer) error {
+	return runCommand(ctx, out, b.command, "tag", source, target)
+}
+
+func (b *cliBuilder) Push(ctx context.Context, tag string, out io.Writer) error {
+	return runCommand(ctx, out, b.command, "push", tag)
+}
+
+func (b *cliBuilder) Inspect(ctx context.Context, tag string) (string, error) {
+	ref := dockerfile.ParseReference(tag)
+	cmd := newCommand(ctx, b.command, "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", tag)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		repoDigest := dockerfile.ParseReference(strings.TrimSpace(line))
+		if repoDigest.Name == ref.Name && repoDigest.Digest != "" {
+			return repoDigest.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no digest found for %s", tag)
+}
+
+// dockerBuilder is the docker CLI, which builds for several platforms with buildx
+type dockerBuilder struct {
+	cliBuilder
+}
+
+func (b *dockerBuilder) BuildAndPush(ctx context.Context, opts BuildOptions, out io.Writer) error {
+	args := []string{"buildx", "build", "--progress=plain", "--platform", strings.Join(opts.Platforms, ","), "--push"}
+	args = append(args, buildFlags(opts)...)
+	args = append(args, opts.Context)
+	return runCommand(ctx, out, "docker", args...)
+}
+
+func (b *dockerBuilder) InspectManifest(ctx context.Context, tag string) (string, error) {
+	cmd := newCommand(ctx, "docker", "buildx", "imagetools", "inspect", "--format", "{{.Manifest.Digest}}", tag)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	digest := strings.TrimSpace(string(output))
+	if digest == "" {
+		return "", fmt.Errorf("no manifest list found for %s", tag)
+	}
+	return digest, nil
+}
+
+// buildahBuilder drives buildah.  buildah doesn't record the digest of a pushed image so it is
+// written to a file on push and remembered for Inspect.
+type buildahBuilder struct {
+	mu      sync.Mutex
+	digests map[string]string
+}
+
+func (b *buildahBuilder) Build(ctx context.Context, opts BuildOptions, out io.Writer) error {
+	args := append([]string{"bud"}, buildFlags(opts)...)
+	args = append(args, opts.Context)
+	return runCommand(ctx, out, "buildah", args...)
+}
+
+func (b *buildahBuilder) Tag(ctx context.Context, source string, target string, out io.Writer) error {
+	return runCommand(ctx, out, "buildah", "tag", source, target)
+}
+
+func (b *buildahBuilder) Push(ctx context.Context, tag string, out io.Writer) error {
+	digestFile, err := ioutil.TempFile("", "docker-chain-builder-digest")
+	if err != nil {
+		return err
+	}
+	digestFile.Close()
+	defer os.Remove(digestFile.Name())
+
+	err = runCommand(ctx, out, "buildah", "push", "--digestfile", digestFile.Name(), tag)
+	if err != nil {
+		return err
+	}
+	digest, err := ioutil.ReadFile(digestFile.Name())
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.digests[tag] = strings.TrimSpace(string(digest))
+	return nil
+}
+
+func (b *buildahBuilder) Inspect(ctx context.Context, tag string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	digest, ok := b.digests[tag]
+	if !ok || digest == "" {
+		return "", fmt.Errorf("no digest found for %s", tag)
+	}
+	return digest, nil
+}
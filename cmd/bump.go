@@ -11,13 +11,27 @@ import (
 	"github.com/spf13/viper"
 )
 
+const (
+	OutputDiff = "diff"
+	OutputJSON = "json"
+)
+
 var (
 	BumpVersions = []string{
 		VersionPre,
+		VersionRelease,
 		VersionPatch,
 		VersionMinor,
 		VersionMajor,
 	}
+	OutputFormats = []string{
+		OutputDiff,
+		OutputJSON,
+	}
+
+	planOnly     bool
+	outputFormat string
+	applyPlan    string
 )
 
 var bumpCmd = &cobra.Command{
@@ -27,21 +41,38 @@ var bumpCmd = &cobra.Command{
 Can take more than one source image.
 Useful for choosing the version bump before running docker-chain-builder build --bump=none in CI`,
 	Args: func(cmd *cobra.Command, args []string) error {
+		if applyPlan != "" {
+			if len(args) > 0 {
+				return fmt.Errorf("--apply takes no source folders as the plan has its own root folder")
+			}
+			return nil
+		}
 		if len(args) < 1 {
 			return fmt.Errorf("please specify at least one source folder")
 		}
+		// Which Dockerfiles a folder has is only known once conf.yaml and image.yaml have been read
 		for _, arg := range args {
-			if _, err := os.Stat(fmt.Sprintf("%s/Dockerfile", filepath.Clean(arg))); os.IsNotExist(err) {
-				return fmt.Errorf("no Dockerfile in %s\n", arg)
+			if info, err := os.Stat(filepath.Clean(arg)); err != nil || !info.IsDir() {
+				return fmt.Errorf("%s is not a folder\n", arg)
 			}
 		}
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		viper.Set("rootFolder", filepath.Dir(filepath.Clean(args[0])))
+		if applyPlan != "" {
+			applyBumpPlan(cmd)
+			return
+		}
+		viper.Set("rootFolder", findRootFolder(args[0]))
 		if !stringInSlice(bumpComponent, BumpVersions) {
 			log.Fatalf("please specify --bump=[%s]", strings.Join(BumpVersions, "|"))
 		}
+		if !stringInSlice(outputFormat, OutputFormats) {
+			log.Fatalf("please specify --output=[%s]", strings.Join(OutputFormats, "|"))
+		}
+		if cmd.Flags().Changed("output") && !planOnly {
+			log.Fatalf("--output only applies to --plan")
+		}
 		loadConfFile()
 		if verbose {
 			log.SetLevel(log.DebugLevel)
@@ -50,16 +81,58 @@ Useful for choosing the version bump before running docker-chain-builder build -
 		}
 		dm := DependencyMap{}
 		dm.initDepencyMap(args)
-		dm.updateVersions(dm.RootImages, false)
+		if len(dm.RootImages) == 0 {
+			log.Fatalf("no Dockerfile in %s", strings.Join(args, ", "))
+		}
+		if planOnly {
+			plan := dm.planBump(dm.RootImages)
+			if err := plan.print(os.Stdout, outputFormat); err != nil {
+				log.Fatalf("couldn't print plan: %v", err)
+			}
+			return
+		}
+		dm.updateVersions(dm.RootImages)
 	},
 }
 
+// applyBumpPlan makes exactly the changes in a plan saved from bump --plan --output json
+func applyBumpPlan(cmd *cobra.Command) {
+	for _, flag := range []string{"bump", "preid", "metadata", "propagate", "build-arg", "plan", "output"} {
+		if cmd.Flags().Changed(flag) {
+			log.Fatalf("--%s can't be used with --apply", flag)
+		}
+	}
+	if verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	plan, err := readBumpPlan(applyPlan)
+	if err != nil {
+		log.Fatalf("not applying %s: %v", applyPlan, err)
+	}
+	if dryRun {
+		plan.logChanges()
+		return
+	}
+	if err := plan.apply(); err != nil {
+		log.Fatalf("couldn't apply %s: %v", applyPlan, err)
+	}
+	log.Infof("applied %d changes to %d files from %s", len(plan.Changes), len(plan.Files), applyPlan)
+}
+
 func init() {
 	rootCmd.AddCommand(bumpCmd)
 
 	helpBump := fmt.Sprintf("semver component to bump [%s] Required", strings.Join(BumpVersions, "|"))
+	helpPropagate := fmt.Sprintf("semver component to bump images built from a bumped image by [%s] (default same or propagate in conf.yaml)", strings.Join(PropagationPolicies, "|"))
 
 	bumpCmd.Flags().StringVar(&bumpComponent, "bump", VersionNone, helpBump)
+	bumpCmd.Flags().StringVar(&preID, "preid", "", "identifier of a pre-release started by --bump pre, e.g. rc")
+	bumpCmd.Flags().StringVar(&buildMetadata, "metadata", "", "build metadata to add to every bumped version, e.g. build.5")
+	bumpCmd.Flags().StringVar(&propagate, "propagate", "", helpPropagate)
+	bumpCmd.Flags().StringArrayVar(&buildArgFlags, "build-arg", nil, "set a build arg for every image, KEY=VALUE or KEY to take it from the environment")
 	bumpCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "show what would happen")
+	bumpCmd.Flags().BoolVar(&planOnly, "plan", false, "print every change the bump would make without writing anything")
+	bumpCmd.Flags().StringVar(&outputFormat, "output", OutputDiff, fmt.Sprintf("format of --plan [%s]", strings.Join(OutputFormats, "|")))
+	bumpCmd.Flags().StringVar(&applyPlan, "apply", "", "apply a plan saved from --plan --output json, refusing if any file in it has changed")
 	bumpCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose mode")
 }
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ImageFile is the optional per image configuration file kept next to VERSION
+	ImageFile = "image.yaml"
+
+	DefaultDockerfile = "Dockerfile"
+	DefaultContext    = "."
+)
+
+// ImageConfig is the configuration of a single image.  Each image starts with the defaults from
+// conf.yaml, is overridden by its entry in the images section of conf.yaml, keyed by folder, and
+// then by the image.yaml in its folder.  Each variant is another image built from the same folder,
+// usually with a different dockerfile or target, configured over the image it is in.
+// BuildArgs and Labels are lists of KEY=VALUE as viper lower cases map keys.
+// Latest and PreReleaseFloatingTags are nil unless they are set in a conf file.
+// Propagate is the component the image is bumped by when an image it is built from is bumped.
+type ImageConfig struct {
+	Propagate              string
+	Timeout                time.Duration
+	Platforms              []string
+	BuildArgs              []string
+	Target                 string
+	Tags                   []string
+	FloatingTags           []string
+	Latest                 *bool
+	PreReleaseFloatingTags *bool
+	Labels                 []string
+	Dockerfile             string
+	Context                string
+	SkipPush               bool
+	Secrets                []string
+	SSH                    []string
+	Variants               map[string]ImageConfig
+}
+
+// loadImageConfigs reads the images section of conf.yaml.  Keys are lower cased as viper is case insensitive.
+func loadImageConfigs() map[string]ImageConfig {
+	configs := make(map[string]ImageConfig)
+	if err := viper.UnmarshalKey("images", &configs); err != nil {
+		log.Fatalf("couldn't read images from conf file: %v", err)
+	}
+	return configs
+}
+
+// loadImageFile reads the image.yaml in folder if there is one
+func loadImageFile(folder string) ImageConfig {
+	config := ImageConfig{}
+	file := filepath.Join(folder, ImageFile)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return config
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		log.Fatalf("couldn't read %s: %v", file, err)
+	}
+	if err := v.Unmarshal(&config); err != nil {
+		log.Fatalf("couldn't read %s: %v", file, err)
+	}
+	log.Debugf("using image file: %s", file)
+	return config
+}
+
+// imageConfig returns the configuration of folder with defaults filled in
+func imageConfig(folder string, defaults ImageConfig, configs map[string]ImageConfig) ImageConfig {
+	return defaults.merge(configs[strings.ToLower(folder)])
+}
+
+// merge returns c overridden by every setting in override.  Build args, labels, secrets and ssh are
+// merged key by key, every other list is replaced.
+func (c ImageConfig) merge(override ImageConfig) ImageConfig {
+	if override.Propagate != "" {
+		c.Propagate = override.Propagate
+	}
+	if override.Timeout != 0 {
+		c.Timeout = override.Timeout
+	}
+	if len(override.Platforms) > 0 {
+		c.Platforms = override.Platforms
+	}
+	c.BuildArgs = append(append([]string{}, c.BuildArgs...), override.BuildArgs...)
+	if override.Target != "" {
+		c.Target = override.Target
+	}
+	if len(override.Tags) > 0 {
+		c.Tags = override.Tags
+	}
+	if len(override.FloatingTags) > 0 {
+		c.FloatingTags = override.FloatingTags
+	}
+	if override.Latest != nil {
+		c.Latest = override.Latest
+	}
+	if override.PreReleaseFloatingTags != nil {
+		c.PreReleaseFloatingTags = override.PreReleaseFloatingTags
+	}
+	c.Labels = append(append([]string{}, c.Labels...), override.Labels...)
+	if override.Dockerfile != "" {
+		c.Dockerfile = override.Dockerfile
+	}
+	if override.Context != "" {
+		c.Context = override.Context
+	}
+	if override.SkipPush {
+		c.SkipPush = true
+	}
+	c.Secrets = mergeSpecs(append(append([]string{}, c.Secrets...), override.Secrets...), secretID)
+	c.SSH = mergeSpecs(append(append([]string{}, c.SSH...), override.SSH...), sshID)
+	if len(override.Variants) > 0 {
+		c.Variants = override.Variants
+	}
+	return c
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// GitInfo is the state of the git repository holding the root folder
+type GitInfo struct {
+	SHA         string
+	Branch      string
+	CommitCount string
+}
+
+var (
+	gitInfoOnce sync.Once
+	gitInfo     GitInfo
+
+	invalidTagCharRegex        = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+	invalidPreReleaseCharRegex = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+	// branchEnvVars hold the branch in CI systems that check out a detached HEAD
+	branchEnvVars = []string{"BRANCH_NAME", "GITHUB_HEAD_REF", "CI_COMMIT_REF_NAME"}
+)
+
+const DefaultGitPreRelease = "{{.Branch}}.{{.GitSHA}}"
+
+// currentGitInfo reads the git state of the root folder the first time it is needed.
+// Anything git can't tell us is left empty.
+func currentGitInfo() GitInfo {
+	gitInfoOnce.Do(func() {
+		gitInfo.SHA = git("rev-parse", "--short=7", "HEAD")
+		gitInfo.Branch = git("rev-parse", "--abbrev-ref", "HEAD")
+		for _, envVar := range branchEnvVars {
+			if gitInfo.Branch != "" && gitInfo.Branch != "HEAD" {
+				break
+			}
+			gitInfo.Branch = os.Getenv(envVar)
+		}
+		gitInfo.CommitCount = git("rev-list", "--count", "HEAD")
+	})
+	return gitInfo
+}
+
+func git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = viper.GetString("rootFolder")
+	output, err := cmd.Output()
+	if err != nil {
+		log.Warnf("git %s failed: %v", strings.Join(args, " "), err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// sanitizeTag replaces every run of characters that aren't allowed in a docker tag with a dash
+func sanitizeTag(s string) string {
+	return strings.Trim(invalidTagCharRegex.ReplaceAllString(s, "-"), "-.")
+}
+
+// gitPreRelease renders the pre-release identifier of a build from the git state of the root folder,
+// e.g. {{.Branch}}.{{.GitSHA}} on branch pr-45 is pr-45.abc1234.  Templates can use .Branch, .GitSHA and .CommitCount.
+func gitPreRelease(preReleaseTemplate string) (string, error) {
+	tmpl, err := template.New("preRelease").Option("missingkey=error").Parse(preReleaseTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid pre-release template %s: %v", preReleaseTemplate, err)
+	}
+	info := currentGitInfo()
+	data := struct {
+		Branch      string
+		GitSHA      string
+		CommitCount string
+	}{info.Branch, info.SHA, info.CommitCount}
+	var preRelease bytes.Buffer
+	if err := tmpl.Execute(&preRelease, data); err != nil {
+		return "", fmt.Errorf("couldn't render pre-release template %s: %v", preReleaseTemplate, err)
+	}
+
+	// Each dot separated identifier of a semver pre-release can only be alphanumerics and dashes
+	// and numeric identifiers can't have leading zeros
+	var identifiers []string
+	for _, identifier := range strings.Split(preRelease.String(), ".") {
+		identifier = strings.Trim(invalidPreReleaseCharRegex.ReplaceAllString(identifier, "-"), "-")
+		if identifier == "" {
+			continue
+		}
+		if len(identifier) > 1 && identifier[0] == '0' && strings.Trim(identifier, "0123456789") == "" {
+			identifier = "g" + identifier
+		}
+		identifiers = append(identifiers, identifier)
+	}
+	if len(identifiers) == 0 {
+		return "", fmt.Errorf("pre-release template %s rendered nothing; is the root folder in a git repository?", preReleaseTemplate)
+	}
+	return strings.Join(identifiers, "."), nil
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	unvisited = iota
+	visiting
+	visited
+)
+
+// checkForCycles walks the whole graph of images and returns an error naming every image
+// in the first circular chain of FROM references it finds
+func (dm *DependencyMap) checkForCycles() error {
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(folder string) error
+	visit = func(folder string) error {
+		switch state[folder] {
+		case visited:
+			return nil
+		case visiting:
+			for idx, pathFolder := range path {
+				if pathFolder == folder {
+					cycle := append(append([]string{}, path[idx:]...), folder)
+					return fmt.Errorf("circular FROM references: %s", strings.Join(cycle, " -> "))
+				}
+			}
+		}
+		state[folder] = visiting
+		path = append(path, folder)
+		for _, child := range dm.getDependents(folder) {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[folder] = visited
+		return nil
+	}
+
+	folders := make([]string, 0, len(dm.DockerImages))
+	for folder := range dm.DockerImages {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		if err := visit(folder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
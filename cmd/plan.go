@@ -0,0 +1,442 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lhopki01/docker-chain-builder/dockerfile"
+	log "github.com/sirupsen/logrus"
+)
+
+// Change is a single line of a VERSION file or Dockerfile rewritten by a bump
+type Change struct {
+	Image      string `json:"image"`
+	OldVersion string `json:"oldVersion"`
+	NewVersion string `json:"newVersion"`
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	OldLine    string `json:"oldLine"`
+	NewLine    string `json:"newLine"`
+}
+
+// FileChange is the whole of a file rewritten by a bump.  File is relative to the root folder and
+// SHA256 and NewSHA256 are of its content before and after.
+type FileChange struct {
+	File       string `json:"file"`
+	SHA256     string `json:"sha256"`
+	NewSHA256  string `json:"newSha256"`
+	OldContent []byte `json:"-"`
+	NewContent []byte `json:"-"`
+}
+
+// BumpPlan is every change a bump makes, worked out before anything is written so a bump
+// either updates every file or none of them.  Root is the absolute path of the root folder so the plan can be
+// applied from anywhere.
+type BumpPlan struct {
+	Root    string       `json:"root"`
+	Changes []Change     `json:"changes"`
+	Files   []FileChange `json:"files"`
+
+	changes map[string]Change
+	content map[string][]byte
+}
+
+func newBumpPlan(root string) *BumpPlan {
+	return &BumpPlan{
+		Root:    root,
+		Changes: []Change{},
+		Files:   []FileChange{},
+		changes: make(map[string]Change),
+		content: make(map[string][]byte),
+	}
+}
+
+// set records the new content of file along with a change to one of its lines.  A line changed more than
+// once, e.g. an ARG used by several FROM lines, is only recorded once.
+func (p *BumpPlan) set(file string, content []byte, change Change) {
+	change.File = file
+	p.content[file] = content
+	p.changes[fmt.Sprintf("%s:%d", file, change.Line)] = change
+}
+
+// finish reads the current content of every file in the plan and fills in the old and new lines of every change
+func (p *BumpPlan) finish() error {
+	files := make([]string, 0, len(p.content))
+	for file := range p.content {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	oldLines := make(map[string][]string)
+	newLines := make(map[string][]string)
+	for _, file := range files {
+		oldContent, err := ioutil.ReadFile(filepath.Join(p.Root, file))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if bytes.Equal(oldContent, p.content[file]) {
+			continue
+		}
+		p.Files = append(p.Files, FileChange{
+			File:       file,
+			SHA256:     sha256Hex(oldContent),
+			NewSHA256:  sha256Hex(p.content[file]),
+			OldContent: oldContent,
+			NewContent: p.content[file],
+		})
+		oldLines[file] = strings.Split(string(oldContent), "\n")
+		newLines[file] = strings.Split(string(p.content[file]), "\n")
+	}
+
+	for _, change := range p.changes {
+		if _, ok := oldLines[change.File]; !ok {
+			continue
+		}
+		change.OldLine = lineOf(oldLines[change.File], change.Line)
+		change.NewLine = lineOf(newLines[change.File], change.Line)
+		if change.OldLine != change.NewLine {
+			p.Changes = append(p.Changes, change)
+		}
+	}
+	sort.Slice(p.Changes, func(i, j int) bool {
+		if p.Changes[i].File != p.Changes[j].File {
+			return p.Changes[i].File < p.Changes[j].File
+		}
+		return p.Changes[i].Line < p.Changes[j].Line
+	})
+	return nil
+}
+
+// readBumpPlan reads a plan printed by bump --plan --output json and works out the new content of every
+// file from its changed lines.  It refuses a plan for files that have changed since it was made.
+func readBumpPlan(planFile string) (*BumpPlan, error) {
+	b, err := ioutil.ReadFile(planFile)
+	if err != nil {
+		return nil, err
+	}
+	plan := &BumpPlan{}
+	if err := json.Unmarshal(b, plan); err != nil {
+		return nil, fmt.Errorf("%s isn't a bump plan: %v", planFile, err)
+	}
+	if plan.Root == "" {
+		return nil, fmt.Errorf("%s has no root folder", planFile)
+	}
+	if !filepath.IsAbs(plan.Root) {
+		plan.Root = filepath.Join(filepath.Dir(planFile), plan.Root)
+	}
+
+	for i, file := range plan.Files {
+		if !insideRoot(file.File) {
+			return nil, fmt.Errorf("%s changes %s which isn't inside the root folder", planFile, file.File)
+		}
+		target := filepath.Join(plan.Root, file.File)
+		oldContent, err := ioutil.ReadFile(target)
+		if err != nil {
+			return nil, err
+		}
+		if sha256Hex(oldContent) != file.SHA256 {
+			return nil, fmt.Errorf("%s has changed since the plan was made", target)
+		}
+		if filepath.Base(file.File) != "VERSION" {
+			if f, err := dockerfile.Parse(oldContent); err != nil || len(f.Froms()) == 0 {
+				return nil, fmt.Errorf("%s changes %s which is neither a VERSION file nor a Dockerfile", planFile, file.File)
+			}
+		}
+
+		lines := splitLines(oldContent)
+		changed := false
+		for _, change := range plan.Changes {
+			if change.File != file.File {
+				continue
+			}
+			if change.Line < 1 || change.Line > len(lines) {
+				return nil, fmt.Errorf("%s has no line %d", target, change.Line)
+			}
+			line := lines[change.Line-1]
+			content := strings.TrimRight(line, "\r\n")
+			if content != change.OldLine {
+				return nil, fmt.Errorf("line %d of %s is '%s' not '%s'", change.Line, target, content, change.OldLine)
+			}
+			lines[change.Line-1] = change.NewLine + line[len(content):]
+			changed = true
+		}
+		if !changed {
+			return nil, fmt.Errorf("%s has no changes to %s", planFile, file.File)
+		}
+		newContent := []byte(strings.Join(lines, ""))
+		if sha256Hex(newContent) != file.NewSHA256 {
+			return nil, fmt.Errorf("the changes to %s in %s don't give the planned file", file.File, planFile)
+		}
+		plan.Files[i].OldContent = oldContent
+		plan.Files[i].NewContent = newContent
+	}
+	for _, change := range plan.Changes {
+		if !plan.hasFile(change.File) {
+			return nil, fmt.Errorf("%s changes %s which isn't in its files", planFile, change.File)
+		}
+	}
+	return plan, plan.validate()
+}
+
+// insideRoot reports whether file, from a plan, is a relative path to a file inside the root folder
+func insideRoot(file string) bool {
+	clean := filepath.Clean(file)
+	if file == "" || clean == "." || filepath.IsAbs(clean) {
+		return false
+	}
+	return clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+func (p *BumpPlan) hasFile(file string) bool {
+	for _, f := range p.Files {
+		if f.File == file {
+			return true
+		}
+	}
+	return false
+}
+
+func sha256Hex(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+func lineOf(lines []string, number int) string {
+	if number < 1 || number > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[number-1], "\r")
+}
+
+// validate checks every new VERSION can be used as a tag and every new Dockerfile can still be parsed
+func (p *BumpPlan) validate() error {
+	for _, file := range p.Files {
+		if filepath.Base(file.File) == "VERSION" {
+			version := strings.TrimSpace(string(file.NewContent))
+			if !tagRegex.MatchString(versionTag(version)) {
+				return fmt.Errorf("%s would be set to %q which isn't a valid tag", file.File, version)
+			}
+			continue
+		}
+		if _, err := dockerfile.Parse(file.NewContent); err != nil {
+			return fmt.Errorf("%s would no longer parse: %v", file.File, err)
+		}
+	}
+	return nil
+}
+
+// logChanges logs every line the plan would change
+func (p *BumpPlan) logChanges() {
+	for _, change := range p.Changes {
+		log.Infof("would update %s line %d to '%s'", filepath.Join(p.Root, change.File), change.Line, change.NewLine)
+	}
+}
+
+// print writes the plan to out as a unified diff of every file or, with format json, as a list of every changed line
+func (p *BumpPlan) print(out io.Writer, format string) error {
+	if format == OutputJSON {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+	}
+	for _, file := range p.Files {
+		if _, err := io.WriteString(out, unifiedDiff(file.File, file.OldContent, file.NewContent)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unifiedDiff returns a unified diff of a file changed from oldContent to newContent that git apply understands.
+// A bump only ever changes lines in place so the lines are compared one for one, anything else is shown
+// as the whole file being replaced.
+func unifiedDiff(file string, oldContent []byte, newContent []byte) string {
+	oldLines := splitLines(oldContent)
+	newLines := splitLines(newContent)
+
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "--- a/%s\n+++ b/%s\n", filepath.ToSlash(file), filepath.ToSlash(file))
+	if len(oldLines) != len(newLines) {
+		fmt.Fprintf(&diff, "@@ -%s +%s @@\n", hunkRange(0, len(oldLines)), hunkRange(0, len(newLines)))
+		writeDiffLines(&diff, "-", oldLines)
+		writeDiffLines(&diff, "+", newLines)
+		return diff.String()
+	}
+
+	for start := 0; start < len(oldLines); {
+		if oldLines[start] == newLines[start] {
+			start++
+			continue
+		}
+		// Take in every change with no more than diffContext unchanged lines between them
+		hunkStart := start - diffContext
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		end := start
+		for i := start; i < len(oldLines) && i <= end+2*diffContext+1; i++ {
+			if oldLines[i] != newLines[i] {
+				end = i
+			}
+		}
+		hunkEnd := end + diffContext + 1
+		if hunkEnd > len(oldLines) {
+			hunkEnd = len(oldLines)
+		}
+		fmt.Fprintf(&diff, "@@ -%s +%s @@\n", hunkRange(hunkStart, hunkEnd-hunkStart), hunkRange(hunkStart, hunkEnd-hunkStart))
+		for i := hunkStart; i < hunkEnd; {
+			if oldLines[i] == newLines[i] {
+				writeDiffLines(&diff, " ", oldLines[i:i+1])
+				i++
+				continue
+			}
+			j := i
+			for j < hunkEnd && oldLines[j] != newLines[j] {
+				j++
+			}
+			writeDiffLines(&diff, "-", oldLines[i:j])
+			writeDiffLines(&diff, "+", newLines[i:j])
+			i = j
+		}
+		start = hunkEnd
+	}
+	return diff.String()
+}
+
+const diffContext = 3
+
+// splitLines splits content into lines each keeping its line ending
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func hunkRange(start int, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func writeDiffLines(diff *strings.Builder, prefix string, lines []string) {
+	for _, line := range lines {
+		diff.WriteString(prefix + line)
+		if !strings.HasSuffix(line, "\n") {
+			diff.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// apply writes every file in the plan, refusing if any has changed since the plan was made
+func (p *BumpPlan) apply() error {
+	return applyFileChanges(p.Root, p.Files)
+}
+
+// applyFileChanges replaces the content of every file under root.  The new content of every file is written
+// next to it before any are renamed over the originals, and if a rename fails every file already replaced
+// is restored, so either every file is updated or none are.
+func applyFileChanges(root string, files []FileChange) error {
+	staged := make([]string, 0, len(files))
+	removeStaged := func() {
+		for _, tmp := range staged {
+			os.Remove(tmp)
+		}
+	}
+	for _, file := range files {
+		target := filepath.Join(root, file.File)
+		current, err := ioutil.ReadFile(target)
+		if err != nil && !os.IsNotExist(err) {
+			removeStaged()
+			return err
+		}
+		if !bytes.Equal(current, file.OldContent) {
+			removeStaged()
+			return fmt.Errorf("%s has changed since the bump was planned", target)
+		}
+		tmp, err := writeTemp(target, file.NewContent)
+		if err != nil {
+			removeStaged()
+			return err
+		}
+		staged = append(staged, tmp)
+	}
+
+	for i, file := range files {
+		target := filepath.Join(root, file.File)
+		if err := os.Rename(staged[i], target); err != nil {
+			for _, tmp := range staged[i:] {
+				os.Remove(tmp)
+			}
+			return rollback(root, files[:i], err)
+		}
+		log.Debugf("updated %s", target)
+	}
+	return nil
+}
+
+// rollback puts back the old content of files after applying a change to them failed with err
+func rollback(root string, files []FileChange, err error) error {
+	var failed []string
+	for _, file := range files {
+		target := filepath.Join(root, file.File)
+		tmp, writeErr := writeTemp(target, file.OldContent)
+		if writeErr != nil {
+			failed = append(failed, target)
+			continue
+		}
+		if renameErr := os.Rename(tmp, target); renameErr != nil {
+			os.Remove(tmp)
+			failed = append(failed, target)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%v and couldn't restore %s", err, strings.Join(failed, ", "))
+	}
+	return fmt.Errorf("%v; every file has been restored", err)
+}
+
+// writeFileAtomic replaces file with content by writing it alongside and renaming it over file
+func writeFileAtomic(file string, content []byte) error {
+	tmp, err := writeTemp(file, content)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes content next to target, with the same permissions as target if it exists, ready to be
+// renamed over it.  It returns the path of the file written.
+func writeTemp(target string, content []byte) (string, error) {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := target + ".docker-chain-builder"
+	if err := ioutil.WriteFile(tmp, content, mode); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	// WriteFile leaves the mode of an existing file alone and is subject to the umask
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// manifestPolicy is how long to wait for a pushed manifest list to be served by the registry
+	manifestPolicy = RetryPolicy{Attempts: 10, Backoff: 2 * time.Second, MaxBackoff: 30 * time.Second}
+
+	platformStepRegex = regexp.MustCompile(`(?m)^#\d+ \[(\S+/\S+)(?: \S+)? (\d+/\d+)\]`)
+)
+
+// checkPlatforms makes sure every image in the build that has platforms can be built for them
+func (dm *DependencyMap) checkPlatforms() error {
+	for _, folder := range dm.imagesToBuild(dm.RootImages) {
+		if len(dm.DockerImages[folder].Config.Platforms) == 0 {
+			continue
+		}
+		if !push || dm.DockerImages[folder].Config.SkipPush {
+			return fmt.Errorf("%s is built for %v which requires --push and skipPush to be unset", folder, dm.DockerImages[folder].Config.Platforms)
+		}
+		if _, ok := dm.Builder.(MultiPlatformBuilder); !ok {
+			return fmt.Errorf("%s is built for %v which the %s builder can't do; use %s or %s", folder,
+				dm.DockerImages[folder].Config.Platforms, builderName, BuilderDocker, BuilderBuildx)
+		}
+	}
+	return nil
+}
+
+// buildMultiPlatformImage builds and pushes folder for every platform in opts as a manifest list.
+// It only returns once the manifest list can be read from the registry so images built from it
+// aren't started before it is available.
+func (dm *DependencyMap) buildMultiPlatformImage(buildCtx context.Context, ctx context.Context, folder string, opts BuildOptions) error {
+	platforms := strings.Join(opts.Platforms, ",")
+	if dryRun {
+		log.Infof("would build %s for %s and push %v", folder, platforms, opts.Tags)
+		if pinDigests {
+			log.Warnf("would pin images built from %s to its digest", opts.Tags[0])
+		}
+		dm.State.SetStatus(folder, StatusSuccess)
+		return nil
+	}
+	builder := dm.Builder.(MultiPlatformBuilder)
+
+	log.Infof("building %s for %s", folder, platforms)
+	dm.State.SetStatus(folder, StatusBuilding)
+	var buildOutput bytes.Buffer
+	err := dm.BuildRetry.do(ctx, func(output io.Writer) error {
+		buildOutput.Reset()
+		return builder.BuildAndPush(ctx, opts, io.MultiWriter(dm.State.Logs(folder), &buildOutput, output))
+	}, dm.onRetry(folder, "build", dm.BuildRetry))
+	if nonInteractive {
+		log.Infof("output of build %s\n%s", folder, dm.State.LogString(folder))
+	}
+	if err != nil {
+		if cancelErr := dm.interrupted(buildCtx, ctx, folder, err); cancelErr != nil {
+			return cancelErr
+		}
+		dm.State.SetFinished(folder, StatusFailure, exitCode(err), "build failed")
+		log.Errorf("build failed for %s with err:\n%v", folder, err)
+		return err
+	}
+	log.Infof("build succeeded for %s", folder)
+
+	dm.State.SetStatus(folder, StatusPushing)
+	var digest string
+	err = manifestPolicy.do(ctx, func(output io.Writer) error {
+		var err error
+		digest, err = builder.InspectManifest(ctx, opts.Tags[0])
+		return err
+	}, func(attempt int, err error, wait time.Duration) {
+		log.Debugf("manifest list %s not available yet, checking again in %s", opts.Tags[0], wait)
+	})
+	if err != nil {
+		if cancelErr := dm.interrupted(buildCtx, ctx, folder, err); cancelErr != nil {
+			return cancelErr
+		}
+		dm.State.SetFinished(folder, StatusFailure, exitCode(err), fmt.Sprintf("manifest list %s not available", opts.Tags[0]))
+		log.Errorf("manifest list %s not available with err:\n%s", opts.Tags[0], err)
+		return err
+	}
+	log.Infof("%s pushed for %s with digest %s", opts.Tags[0], platforms, digest)
+	if pinDigests {
+		dm.State.SetDigest(folder, digest)
+	}
+
+	if buildWasCached(buildOutput.String()) {
+		dm.State.SetStatus(folder, StatusCached)
+	} else {
+		dm.State.SetStatus(folder, StatusSuccess)
+	}
+	return nil
+}
+
+// platformProgress returns the latest step buildx has reached for each platform, e.g. "linux/amd64 2/3"
+func platformProgress(logs string, platforms []string) []string {
+	steps := make(map[string]string)
+	for _, m := range platformStepRegex.FindAllStringSubmatch(logs, -1) {
+		steps[m[1]] = m[2]
+	}
+	var progress []string
+	for _, platform := range platforms {
+		step, ok := steps[platform]
+		if !ok {
+			step = "waiting"
+		}
+		progress = append(progress, fmt.Sprintf("%s %s", platform, step))
+	}
+	return progress
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// RetryPolicy is how often a phase of a build (docker build or docker push) is attempted.
+// If RetryOn is empty every failure is retried, otherwise only failures whose output matches
+// one of the regular expressions are.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	RetryOn    []string
+	retryOn    []*regexp.Regexp
+}
+
+// loadRetryPolicy reads retries.<phase> from conf.yaml.  attempts overrides the conf file if it is above zero.
+func loadRetryPolicy(phase string, attempts int) RetryPolicy {
+	policy := RetryPolicy{}
+	if err := viper.UnmarshalKey(fmt.Sprintf("retries.%s", phase), &policy); err != nil {
+		log.Fatalf("couldn't read retries.%s from conf file: %v", phase, err)
+	}
+	if attempts > 0 {
+		policy.Attempts = attempts
+	}
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = 5 * time.Second
+	}
+	for _, pattern := range policy.RetryOn {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("invalid retries.%s.retryOn pattern %s: %v", phase, pattern, err)
+		}
+		policy.retryOn = append(policy.retryOn, regex)
+	}
+	return policy
+}
+
+func (p RetryPolicy) retryable(output string) bool {
+	if len(p.retryOn) == 0 {
+		return true
+	}
+	for _, regex := range p.retryOn {
+		if regex.MatchString(output) {
+			return true
+		}
+	}
+	return false
+}
+
+// do calls attempt until it succeeds, fails with output that isn't retryable, runs out of attempts
+// or ctx is done.  The wait between attempts doubles each time up to MaxBackoff.
+// attempt is passed a writer that only captures the output of that attempt.
+func (p RetryPolicy) do(ctx context.Context, attempt func(output io.Writer) error, onRetry func(attempt int, err error, wait time.Duration)) error {
+	backoff := p.Backoff
+	for n := 1; ; n++ {
+		var output bytes.Buffer
+		err := attempt(&output)
+		if err == nil || ctx.Err() != nil || n >= p.Attempts || !p.retryable(output.String()) {
+			return err
+		}
+		onRetry(n, err, backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
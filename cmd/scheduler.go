@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type buildResult struct {
+	folder string
+	err    error
+}
+
+// imagesToBuild returns images and every image built from them, sorted.  Variants share the VERSION of
+// their folder so every other variant of a folder in the build, and every image built from it, is included.
+func (dm *DependencyMap) imagesToBuild(images []string) []string {
+	var nodes []string
+	seen := make(map[string]bool)
+	queue := append([]string{}, images...)
+	for len(queue) > 0 {
+		image := queue[0]
+		queue = queue[1:]
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		nodes = append(nodes, image)
+		queue = append(queue, dm.imagesInFolder(dm.DockerImages[image].Folder)...)
+		queue = append(queue, dm.getDependents(image)...)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// buildDockerImages builds images and every image built from them.  An image is started once all
+// of its parents in the build have succeeded and at most dm.Parallelism images are built at once.
+// Images built from a failed image are skipped.  With --fail-fast the first failure cancels every
+// build in progress and nothing else is started.
+func (dm *DependencyMap) buildDockerImages(ctx context.Context, images []string) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	nodes := dm.imagesToBuild(images)
+	if len(nodes) == 0 {
+		return
+	}
+
+	children := make(map[string][]string)
+	inDegree := make(map[string]int)
+	for _, node := range nodes {
+		children[node] = dm.getDependents(node)
+		for _, child := range children[node] {
+			inDegree[child]++
+		}
+	}
+
+	ready := make(chan string, len(nodes))
+	results := make(chan buildResult, len(nodes))
+	for _, node := range nodes {
+		dm.State.SetStatus(node, StatusQueued)
+	}
+	for _, node := range nodes {
+		if inDegree[node] == 0 {
+			ready <- node
+		}
+	}
+
+	workers := dm.Parallelism
+	if workers <= 0 || workers > len(nodes) {
+		workers = len(nodes)
+	}
+	log.Debugf("building %d images with %d workers", len(nodes), workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for folder := range ready {
+				if err := dm.cancelled(ctx, folder, nil); err != nil {
+					results <- buildResult{folder: folder, err: err}
+					continue
+				}
+				results <- buildResult{folder: folder, err: dm.buildDockerImage(ctx, folder)}
+			}
+		}()
+	}
+
+	blocked := make(map[string]bool)
+	remaining := len(nodes)
+	for remaining > 0 {
+		result := <-results
+		remaining--
+		if result.err != nil {
+			status := dm.State.Status(result.folder)
+			reason := fmt.Sprintf("%s %s", result.folder, status)
+			if status == StatusFailure {
+				reason = fmt.Sprintf("%s failed", result.folder)
+				if failFast && ctx.Err() == nil {
+					log.Warnf("cancelling the build as %s failed", result.folder)
+					cancel(errors.New(reason))
+				}
+			}
+			for _, descendant := range dm.getChildren(result.folder) {
+				if !blocked[descendant] {
+					blocked[descendant] = true
+					remaining--
+					dm.State.SetFinished(descendant, StatusSkipped, 0, reason)
+					log.Warnf("not building %s as %s", descendant, reason)
+				}
+			}
+			continue
+		}
+		for _, child := range children[result.folder] {
+			inDegree[child]--
+			if inDegree[child] == 0 && !blocked[child] {
+				ready <- child
+			}
+		}
+	}
+	close(ready)
+	wg.Wait()
+}
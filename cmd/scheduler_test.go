@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBuilder records the order images are built in and fails the images in fail
+type fakeBuilder struct {
+	mu      sync.Mutex
+	events  []string
+	running int
+	maxRun  int
+	fail    map[string]bool
+	slow    map[string]bool
+}
+
+func (b *fakeBuilder) Build(ctx context.Context, opts BuildOptions, out io.Writer) error {
+	name := opts.Tags[0][strings.LastIndex(opts.Tags[0], "/")+1 : strings.LastIndex(opts.Tags[0], ":")]
+	b.mu.Lock()
+	b.events = append(b.events, "start "+name)
+	b.running++
+	if b.running > b.maxRun {
+		b.maxRun = b.running
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.events = append(b.events, "end "+name)
+		b.running--
+		b.mu.Unlock()
+	}()
+
+	fmt.Fprintf(out, "building %s\n", name)
+	wait := 10 * time.Millisecond
+	if b.slow[name] {
+		wait = 10 * time.Second
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+	}
+	if b.fail[name] {
+		return errors.New("exit status 1")
+	}
+	return nil
+}
+
+func (b *fakeBuilder) Tag(ctx context.Context, source string, target string, out io.Writer) error {
+	return nil
+}
+
+func (b *fakeBuilder) Push(ctx context.Context, tag string, out io.Writer) error {
+	return nil
+}
+
+func (b *fakeBuilder) Inspect(ctx context.Context, tag string) (string, error) {
+	return "sha256:0", nil
+}
+
+func (b *fakeBuilder) index(event string) int {
+	for i, e := range b.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+// newTestDependencyMap makes a build of images, each mapped to the images it is built from
+func newTestDependencyMap(images map[string][]string, builder Builder, parallelism int) *DependencyMap {
+	dm := &DependencyMap{
+		Registry:        "registry",
+		SemverComponent: VersionNone,
+		Parallelism:     parallelism,
+		Builder:         builder,
+		DockerImages:    make(DockerImages),
+	}
+	var folders []string
+	for name, parents := range images {
+		dockerImage := &DockerImage{
+			Name:    name,
+			Folder:  name,
+			Image:   fmt.Sprintf("registry/%s:1.0.0", name),
+			Version: "1.0.0",
+			Config:  ImageConfig{Dockerfile: DefaultDockerfile, Context: DefaultContext, Propagate: PropagateSame},
+		}
+		for _, parent := range parents {
+			dockerImage.Stages = append(dockerImage.Stages, Stage{FromImage: fmt.Sprintf("registry/%s:1.0.0", parent)})
+		}
+		dm.DockerImages[name] = dockerImage
+		folders = append(folders, name)
+	}
+	dm.State = newBuildState(folders)
+	return dm
+}
+
+var testImages = map[string][]string{
+	"a": nil,
+	"b": {"a"},
+	"c": {"a"},
+	"d": {"b", "c"},
+	"e": nil,
+}
+
+func TestBuildDockerImagesOrder(t *testing.T) {
+	builder := &fakeBuilder{}
+	dm := newTestDependencyMap(testImages, builder, 2)
+	dm.buildDockerImages(context.Background(), []string{"a", "e"})
+
+	if len(builder.events) != 2*len(testImages) {
+		t.Fatalf("events = %v, want every image built once", builder.events)
+	}
+	for image, parents := range testImages {
+		for _, parent := range parents {
+			if builder.index("end "+parent) > builder.index("start "+image) {
+				t.Errorf("%s started before %s finished: %v", image, parent, builder.events)
+			}
+		}
+		if status := dm.State.Status(image); status != StatusSuccess {
+			t.Errorf("%s is %s, want %s", image, status, StatusSuccess)
+		}
+	}
+	if builder.maxRun > 2 {
+		t.Errorf("%d images built at once, want at most 2", builder.maxRun)
+	}
+	if dm.State.Failed() {
+		t.Error("Failed() = true, want false")
+	}
+}
+
+func TestBuildDockerImagesSkipsImagesBuiltFromFailure(t *testing.T) {
+	builder := &fakeBuilder{fail: map[string]bool{"b": true}}
+	dm := newTestDependencyMap(testImages, builder, 0)
+	dm.buildDockerImages(context.Background(), []string{"a", "e"})
+
+	want := map[string]BuildStatus{
+		"a": StatusSuccess,
+		"b": StatusFailure,
+		"c": StatusSuccess,
+		"d": StatusSkipped,
+		"e": StatusSuccess,
+	}
+	for image, status := range want {
+		if got := dm.State.Status(image); got != status {
+			t.Errorf("%s is %s, want %s", image, got, status)
+		}
+	}
+	if builder.index("start d") >= 0 {
+		t.Errorf("d was built from a failed image: %v", builder.events)
+	}
+	if got := dm.State.Result("d").Reason; got != "b failed" {
+		t.Errorf("d skipped because %q, want %q", got, "b failed")
+	}
+	if !strings.Contains(dm.State.LogString("b"), "building b") {
+		t.Errorf("logs of b = %q, want the build output", dm.State.LogString("b"))
+	}
+}
+
+func TestBuildDockerImagesFailFast(t *testing.T) {
+	failFast = true
+	defer func() { failFast = false }()
+
+	builder := &fakeBuilder{fail: map[string]bool{"a": true}, slow: map[string]bool{"e": true}}
+	dm := newTestDependencyMap(testImages, builder, 0)
+	start := time.Now()
+	dm.buildDockerImages(context.Background(), []string{"a", "e"})
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("build took %s, want e cancelled as soon as a failed", elapsed)
+	}
+	want := map[string]BuildStatus{
+		"a": StatusFailure,
+		"b": StatusSkipped,
+		"c": StatusSkipped,
+		"d": StatusSkipped,
+		"e": StatusCancelled,
+	}
+	for image, status := range want {
+		if got := dm.State.Status(image); got != status {
+			t.Errorf("%s is %s, want %s", image, got, status)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	redacted = "****"
+	// minSecretLength stops short values, which would match all over the logs, from being redacted
+	minSecretLength = 4
+)
+
+// secretFields splits a --secret spec, e.g. id=npmrc,src=/home/ci/.npmrc, into its fields
+func secretFields(spec string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		} else {
+			fields[kv[0]] = ""
+		}
+	}
+	return fields
+}
+
+// secretID returns the id of a --secret spec
+func secretID(spec string) string {
+	return secretFields(spec)["id"]
+}
+
+// sshID returns the id of an --ssh spec, e.g. default or deploy=/home/ci/.ssh/id_rsa
+func sshID(spec string) string {
+	return strings.SplitN(spec, "=", 2)[0]
+}
+
+// mergeSpecs removes all but the last spec with each id, keeping the order they were first seen in
+func mergeSpecs(specs []string, id func(string) string) []string {
+	last := make(map[string]string)
+	var ids []string
+	for _, spec := range specs {
+		if _, ok := last[id(spec)]; !ok {
+			ids = append(ids, id(spec))
+		}
+		last[id(spec)] = spec
+	}
+	merged := make([]string, 0, len(ids))
+	for _, specID := range ids {
+		merged = append(merged, last[specID])
+	}
+	return merged
+}
+
+// secretValues reads the values of secrets from the environment or the files they come from so
+// they can be redacted from the output of builds.  Every line of a file is redacted on its own.
+func secretValues(specs []string) []string {
+	var values []string
+	for _, spec := range specs {
+		fields := secretFields(spec)
+		var value []byte
+		switch {
+		case fields["env"] != "":
+			value = []byte(os.Getenv(fields["env"]))
+		case fields["src"] != "" || fields["source"] != "":
+			file := fields["src"]
+			if file == "" {
+				file = fields["source"]
+			}
+			var err error
+			if value, err = ioutil.ReadFile(file); err != nil {
+				log.Warnf("couldn't read secret %s from %s to redact it: %v", fields["id"], file, err)
+			}
+		default:
+			value = []byte(os.Getenv(fields["id"]))
+		}
+		for _, line := range bytes.Split(value, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) >= minSecretLength {
+				values = append(values, string(line))
+			}
+		}
+	}
+	// Longest first so a secret containing another is redacted whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return unique(values)
+}
+
+// redact replaces every secret in b
+func redact(b []byte, secrets []string) []byte {
+	for _, secret := range secrets {
+		b = bytes.Replace(b, []byte(secret), []byte(redacted), -1)
+	}
+	return b
+}
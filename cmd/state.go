@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// BuildStatus is how far an image has got through the build
+type BuildStatus string
+
+const (
+	StatusPending   BuildStatus = ""
+	StatusQueued    BuildStatus = "queued"
+	StatusBuilding  BuildStatus = "building"
+	StatusPushing   BuildStatus = "pushing"
+	StatusSuccess   BuildStatus = "success"
+	StatusCached    BuildStatus = "cached"
+	StatusFailure   BuildStatus = "failure"
+	StatusSkipped   BuildStatus = "skipped"
+	StatusCancelled BuildStatus = "cancelled"
+)
+
+// Finished reports whether an image with this status will not change status again
+func (s BuildStatus) Finished() bool {
+	switch s {
+	case StatusSuccess, StatusCached, StatusFailure, StatusSkipped, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// ImageResult is a snapshot of the build state of a single image
+type ImageResult struct {
+	Folder   string
+	Status   BuildStatus
+	Started  time.Time
+	Finished time.Time
+	ExitCode int
+	Reason   string
+	Retries  int
+}
+
+// Duration is how long the image took to build and push, or how long it has taken so far
+func (r ImageResult) Duration() time.Duration {
+	if r.Started.IsZero() {
+		return 0
+	}
+	if r.Finished.IsZero() {
+		return time.Since(r.Started)
+	}
+	return r.Finished.Sub(r.Started)
+}
+
+// BuildState records the status, timings, digest and logs of every image in a build.
+// The builder writes to it while the gui and loggers read from it so every access is guarded.
+type BuildState struct {
+	mu      sync.RWMutex
+	images  map[string]*imageState
+	secrets []string
+}
+
+type imageState struct {
+	status   BuildStatus
+	started  time.Time
+	finished time.Time
+	exitCode int
+	reason   string
+	retries  int
+	digest   string
+	logs     *syncBuffer
+}
+
+// syncBuffer is a bytes.Buffer that can be written to and read from different goroutines.
+// Any secrets are redacted as they are written so they are never shown.
+type syncBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	secrets []string
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.secrets) == 0 {
+		return b.buf.Write(p)
+	}
+	// A secret may have been split across writes so the end of what was already written is redacted again
+	start := b.buf.Len() - len(b.secrets[0])
+	if start < 0 {
+		start = 0
+	}
+	content := append([]byte{}, b.buf.Bytes()[start:]...)
+	b.buf.Truncate(start)
+	b.buf.Write(redact(append(content, p...), b.secrets))
+	return len(p), nil
+}
+
+// Redact sets the secrets to redact from everything written from now on, longest first
+func (b *syncBuffer) Redact(secrets []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.secrets = secrets
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newBuildState(folders []string) *BuildState {
+	state := &BuildState{images: make(map[string]*imageState)}
+	for _, folder := range folders {
+		state.images[folder] = &imageState{logs: &syncBuffer{}}
+	}
+	return state
+}
+
+func (s *BuildState) image(folder string) *imageState {
+	s.mu.RLock()
+	image, ok := s.images[folder]
+	s.mu.RUnlock()
+	if ok {
+		return image
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if image, ok = s.images[folder]; !ok {
+		image = &imageState{logs: &syncBuffer{secrets: s.secrets}}
+		s.images[folder] = image
+	}
+	return image
+}
+
+// SetStatus records the status of an image.  The first time an image starts building its start
+// time is recorded and its finish time is recorded once it has finished.
+func (s *BuildState) SetStatus(folder string, status BuildStatus) {
+	image := s.image(folder)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.setStatus(status)
+}
+
+// SetFinished records an image as finished with a status that isn't a success, along with why
+func (s *BuildState) SetFinished(folder string, status BuildStatus, exitCode int, reason string) {
+	image := s.image(folder)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.setStatus(status)
+	image.exitCode = exitCode
+	image.reason = reason
+}
+
+func (i *imageState) setStatus(status BuildStatus) {
+	i.status = status
+	if status == StatusBuilding && i.started.IsZero() {
+		i.started = time.Now()
+	}
+	if status.Finished() {
+		i.finished = time.Now()
+	}
+}
+
+// AddRetry records that a phase of the build of an image is being retried
+func (s *BuildState) AddRetry(folder string) {
+	image := s.image(folder)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.retries++
+}
+
+// Status returns the status of an image
+func (s *BuildState) Status(folder string) BuildStatus {
+	image := s.image(folder)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return image.status
+}
+
+// Result returns a snapshot of the build state of an image
+func (s *BuildState) Result(folder string) ImageResult {
+	image := s.image(folder)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return ImageResult{
+		Folder:   folder,
+		Status:   image.status,
+		Started:  image.started,
+		Finished: image.finished,
+		ExitCode: image.exitCode,
+		Reason:   image.reason,
+		Retries:  image.retries,
+	}
+}
+
+// Results returns a snapshot of every image that is part of the build sorted by folder
+func (s *BuildState) Results() []ImageResult {
+	s.mu.RLock()
+	folders := make([]string, 0, len(s.images))
+	for folder, image := range s.images {
+		if image.status != StatusPending {
+			folders = append(folders, folder)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(folders)
+
+	results := make([]ImageResult, 0, len(folders))
+	for _, folder := range folders {
+		results = append(results, s.Result(folder))
+	}
+	return results
+}
+
+// CancelUnfinished marks every image that was part of the build but hasn't finished as cancelled
+func (s *BuildState) CancelUnfinished(reason string) {
+	for _, result := range s.Results() {
+		if !result.Status.Finished() {
+			s.SetFinished(result.Folder, StatusCancelled, 0, reason)
+		}
+	}
+}
+
+// PrintSummary writes a table of the status and timings of every image that was part of the build
+func (s *BuildState) PrintSummary(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tSTATUS\tDURATION\tRETRIES\tEXIT CODE\tREASON")
+	for _, result := range s.Results() {
+		exitCode := ""
+		if result.ExitCode != 0 {
+			exitCode = fmt.Sprintf("%d", result.ExitCode)
+		}
+		duration := ""
+		if !result.Started.IsZero() {
+			duration = result.Duration().Round(100 * time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			result.Folder,
+			result.Status,
+			duration,
+			result.Retries,
+			exitCode,
+			result.Reason,
+		)
+	}
+	tw.Flush()
+}
+
+// SetDigest records the digest an image was pushed with
+func (s *BuildState) SetDigest(folder string, digest string) {
+	image := s.image(folder)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.digest = digest
+}
+
+// Digest returns the digest an image was pushed with or an empty string if it hasn't been pushed
+func (s *BuildState) Digest(folder string) string {
+	image := s.image(folder)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return image.digest
+}
+
+// Redact sets the secrets to redact from the logs of every image
+func (s *BuildState) Redact(secrets []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets = secrets
+	for _, image := range s.images {
+		image.logs.Redact(secrets)
+	}
+}
+
+// Logs returns the writer the output of docker commands for an image is captured in
+func (s *BuildState) Logs(folder string) io.Writer {
+	return s.image(folder).logs
+}
+
+// LogString returns everything captured for an image so far
+func (s *BuildState) LogString(folder string) string {
+	return s.image(folder).logs.String()
+}
+
+// Failed reports whether any image failed or was cancelled
+func (s *BuildState) Failed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, image := range s.images {
+		if image.status == StatusFailure || image.status == StatusCancelled {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBuildStateConcurrentAccess(t *testing.T) {
+	folders := []string{"a", "b", "c", "d"}
+	state := newBuildState(folders)
+	state.Redact([]string{"hunter22"})
+
+	const writes = 200
+	var wg sync.WaitGroup
+	for _, folder := range folders {
+		wg.Add(1)
+		go func(folder string) {
+			defer wg.Done()
+			state.SetStatus(folder, StatusQueued)
+			state.SetStatus(folder, StatusBuilding)
+			for i := 0; i < writes; i++ {
+				fmt.Fprintf(state.Logs(folder), "step %d of %s with hunter22\n", i, folder)
+				if i%50 == 0 {
+					state.AddRetry(folder)
+				}
+			}
+			state.SetDigest(folder, "sha256:"+folder)
+			if folder == "d" {
+				state.SetFinished(folder, StatusFailure, 1, "build failed")
+				return
+			}
+			state.SetStatus(folder, StatusSuccess)
+		}(folder)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, folder := range folders {
+					state.Status(folder)
+					state.LogString(folder)
+					state.Digest(folder)
+				}
+				state.Results()
+				state.Failed()
+				state.PrintSummary(ioutil.Discard)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for _, result := range state.Results() {
+		logs := state.LogString(result.Folder)
+		if got := strings.Count(logs, "\n"); got != writes {
+			t.Errorf("%s has %d log lines, want %d", result.Folder, got, writes)
+		}
+		if strings.Contains(logs, "hunter22") {
+			t.Errorf("%s logs contain the secret", result.Folder)
+		}
+		if result.Retries != writes/50 {
+			t.Errorf("%s has %d retries, want %d", result.Folder, result.Retries, writes/50)
+		}
+		if result.Started.IsZero() || result.Finished.IsZero() {
+			t.Errorf("%s started %v and finished %v, want both set", result.Folder, result.Started, result.Finished)
+		}
+		want := StatusSuccess
+		if result.Folder == "d" {
+			want = StatusFailure
+		}
+		if result.Status != want {
+			t.Errorf("%s is %s, want %s", result.Folder, result.Status, want)
+		}
+	}
+	if !state.Failed() {
+		t.Error("Failed() = false, want true as d failed")
+	}
+}
+
+func TestBuildStateCancelUnfinished(t *testing.T) {
+	state := newBuildState([]string{"a", "b", "c"})
+	state.SetStatus("a", StatusSuccess)
+	state.SetStatus("b", StatusBuilding)
+	state.CancelUnfinished("interrupted")
+
+	if got := state.Result("a"); got.Status != StatusSuccess {
+		t.Errorf("a is %s, want %s", got.Status, StatusSuccess)
+	}
+	if got := state.Result("b"); got.Status != StatusCancelled || got.Reason != "interrupted" {
+		t.Errorf("b is %s (%s), want %s (interrupted)", got.Status, got.Reason, StatusCancelled)
+	}
+	if got := state.Status("c"); got != StatusPending {
+		t.Errorf("c is %q, want it left pending as it was never part of the build", got)
+	}
+}
+
+func TestSyncBufferRedactsSplitSecrets(t *testing.T) {
+	buf := &syncBuffer{}
+	buf.Redact([]string{"hunter22"})
+	for _, write := range []string{"password is hun", "ter", "22 and again hunter22\n"} {
+		fmt.Fprint(buf, write)
+	}
+	if got, want := buf.String(), "password is "+redacted+" and again "+redacted+"\n"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
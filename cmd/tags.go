@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+var (
+	// DefaultFloatingTags move to the newest image of a major or minor version
+	DefaultFloatingTags = []string{
+		"{{.Major}}.{{.Minor}}.{{.Patch}}",
+		"{{.Major}}.{{.Minor}}",
+		"{{.Major}}",
+	}
+
+	tagRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// TagData is what tag templates are rendered with
+type TagData struct {
+	Version    string
+	Major      int64
+	Minor      int64
+	Patch      int64
+	PreRelease string
+	Date       string
+}
+
+// GitSHA is the short SHA of the commit being built
+func (d TagData) GitSHA() string {
+	return currentGitInfo().SHA
+}
+
+// Branch is the branch being built with any characters docker doesn't allow in a tag replaced
+func (d TagData) Branch() string {
+	return sanitizeTag(currentGitInfo().Branch)
+}
+
+// imageTags returns the tags an image with version is pushed with.  The version itself always comes
+// first as it is what images built from it reference.  Floating tags and latest aren't added for
+// pre-releases when preReleaseFloatingTags is false.
+func imageTags(version string, config ImageConfig) ([]string, error) {
+	data := TagData{Version: versionTag(version), Date: time.Now().UTC().Format("20060102")}
+	floatingTags := config.FloatingTags
+	if len(floatingTags) == 0 {
+		floatingTags = DefaultFloatingTags
+	}
+	latest := config.Latest == nil || *config.Latest
+
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		// Without semver there is nothing to float
+		floatingTags = nil
+	} else {
+		data.Major = v.Major()
+		data.Minor = v.Minor()
+		data.Patch = v.Patch()
+		data.PreRelease = v.Prerelease()
+		if data.PreRelease != "" && config.PreReleaseFloatingTags != nil && !*config.PreReleaseFloatingTags {
+			floatingTags = nil
+			latest = false
+		}
+	}
+
+	tags := []string{versionTag(version)}
+	for _, tagTemplate := range append(append([]string{}, config.Tags...), floatingTags...) {
+		tag, err := renderTag(tagTemplate, data)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if latest {
+		tags = append(tags, "latest")
+	}
+	return unique(tags), nil
+}
+
+// versionTag is the docker tag of version.  Docker tags can't contain the + that starts semver build
+// metadata so it is written as _, which can't appear in a semver version.
+func versionTag(version string) string {
+	return strings.Replace(version, "+", "_", 1)
+}
+
+// tagVersion is the version a docker tag made by versionTag is of
+func tagVersion(tag string) string {
+	return strings.Replace(tag, "_", "+", 1)
+}
+
+func renderTag(tagTemplate string, data TagData) (string, error) {
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(tagTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid tag template %s: %v", tagTemplate, err)
+	}
+	var tag bytes.Buffer
+	if err := tmpl.Execute(&tag, data); err != nil {
+		return "", fmt.Errorf("couldn't render tag template %s: %v", tagTemplate, err)
+	}
+	if !tagRegex.MatchString(tag.String()) {
+		return "", fmt.Errorf("tag template %s rendered %q which isn't a valid tag", tagTemplate, tag.String())
+	}
+	return tag.String(), nil
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newWorkspace copies the root folder, apart from .git, into a temporary folder so VERSION files and
+// FROM lines can be rewritten for a build without touching the working tree.  Every image in the build
+// must have its context inside the root folder.
+func (dm *DependencyMap) newWorkspace() (string, error) {
+	for _, folder := range dm.imagesToBuild(dm.RootImages) {
+		buildContext := filepath.Join(dm.DockerImages[folder].Folder, dm.DockerImages[folder].Config.Context)
+		if buildContext == ".." || strings.HasPrefix(buildContext, "../") {
+			return "", fmt.Errorf("the context of %s is outside %s so it can't be built in a workspace", folder, dm.BasePath)
+		}
+	}
+	workspace, err := ioutil.TempDir("", "docker-chain-builder")
+	if err != nil {
+		return "", err
+	}
+	if err := copyTree(dm.BasePath, workspace); err != nil {
+		os.RemoveAll(workspace)
+		return "", err
+	}
+	log.Infof("building in workspace %s", workspace)
+	return workspace, nil
+}
+
+// copyTree copies every file, folder and symlink in src to dst, skipping .git
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		switch {
+		case info.IsDir() && info.Name() == ".git":
+			return filepath.SkipDir
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeBack copies the VERSION file and Dockerfile of every image in the build that changed in the
+// workspace back to root.  Either every file is written or the working tree is left untouched.
+func (dm *DependencyMap) writeBack(workspace string, root string) error {
+	var files []string
+	for _, folder := range dm.imagesToBuild(dm.RootImages) {
+		files = append(files,
+			filepath.Join(dm.DockerImages[folder].Folder, "VERSION"),
+			filepath.Join(dm.DockerImages[folder].Folder, dm.DockerImages[folder].Config.Dockerfile),
+		)
+	}
+
+	var changes []FileChange
+	for _, file := range unique(files) {
+		newContent, err := ioutil.ReadFile(filepath.Join(workspace, file))
+		if err != nil {
+			return err
+		}
+		oldContent, err := ioutil.ReadFile(filepath.Join(root, file))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if bytes.Equal(newContent, oldContent) {
+			continue
+		}
+		changes = append(changes, FileChange{File: file, OldContent: oldContent, NewContent: newContent})
+	}
+	if err := applyFileChanges(root, changes); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		log.Infof("updated %s", filepath.Join(root, change.File))
+	}
+	return nil
+}
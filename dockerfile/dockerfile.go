@@ -0,0 +1,361 @@
+// Package dockerfile parses the instructions of a Dockerfile while remembering where every word came
+// from, so a file can be rewritten byte for byte apart from the words that are replaced.
+package dockerfile
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// File is a parsed Dockerfile
+type File struct {
+	Instructions []*Instruction
+	src          []byte
+	edits        map[int]edit
+}
+
+// Instruction is a single instruction with any line continuations, comments and heredocs already resolved
+type Instruction struct {
+	Cmd   string
+	Flags []Word
+	Args  []Word
+	Line  int
+}
+
+// Word is a whitespace separated word of an instruction.  Start and End are offsets into the original file.
+type Word struct {
+	Value string
+	Start int
+	End   int
+}
+
+// From is a FROM instruction
+type From struct {
+	Instruction *Instruction
+	Platform    string
+	Image       Word
+	Alias       string
+}
+
+// Arg is an ARG instruction.  Global ARGs are declared before the first FROM and can be used in FROM lines.
+type Arg struct {
+	Instruction *Instruction
+	Name        string
+	Default     Word
+	HasDefault  bool
+	Global      bool
+}
+
+type edit struct {
+	end   int
+	value string
+}
+
+var (
+	utf8BOM = []byte("\xef\xbb\xbf")
+
+	directiveRegex = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+	heredocRegex   = regexp.MustCompile(`^<<(-?)(["']?)([a-zA-Z_][a-zA-Z0-9_]*)(["']?)`)
+)
+
+// Parse splits src into instructions
+func Parse(src []byte) (*File, error) {
+	f := &File{src: src, edits: make(map[int]edit)}
+	escape := byte('\\')
+
+	lines := splitLines(src)
+	// Docker ignores a UTF-8 byte order mark at the start of the file
+	if len(lines) > 0 && bytes.HasPrefix(src, utf8BOM) {
+		lines[0].start += len(utf8BOM)
+	}
+	inDirectives := true
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(string(src[line.start:line.end]))
+
+		if inDirectives {
+			if m := directiveRegex.FindStringSubmatch(trimmed); m != nil {
+				if strings.ToLower(m[1]) == "escape" {
+					if m[2] != "\\" && m[2] != "`" {
+						return nil, fmt.Errorf("line %d: invalid escape token %q", i+1, m[2])
+					}
+					escape = m[2][0]
+				}
+				continue
+			}
+			inDirectives = false
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// Join continuation lines, keeping the offset every character came from
+		var text []byte
+		var offsets []int
+		startLine := i
+		for {
+			content := src[line.start:line.end]
+			end := len(bytes.TrimRight(content, " \t\r"))
+			continued := end > 0 && content[end-1] == escape
+			if continued {
+				end--
+			}
+			for j := 0; j < end; j++ {
+				text = append(text, content[j])
+				offsets = append(offsets, line.start+j)
+			}
+			if !continued {
+				break
+			}
+			// Comments and empty lines inside a continuation are dropped
+			for i++; i < len(lines); i++ {
+				next := strings.TrimSpace(string(src[lines[i].start:lines[i].end]))
+				if next != "" && !strings.HasPrefix(next, "#") {
+					break
+				}
+			}
+			if i == len(lines) {
+				break
+			}
+			line = lines[i]
+		}
+
+		words := splitWords(text, offsets)
+		if len(words) == 0 {
+			continue
+		}
+		instruction := &Instruction{Cmd: strings.ToUpper(words[0].Value), Line: startLine + 1}
+		args := words[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0].Value, "--") {
+			instruction.Flags = append(instruction.Flags, args[0])
+			args = args[1:]
+		}
+		instruction.Args = args
+
+		// Skip the bodies of any heredocs so nothing in them is mistaken for an instruction
+		for _, arg := range args {
+			m := heredocRegex.FindStringSubmatch(arg.Value)
+			if m == nil || m[2] != m[4] {
+				continue
+			}
+			for i++; i < len(lines); i++ {
+				body := string(src[lines[i].start:lines[i].end])
+				body = strings.TrimRight(body, "\r")
+				if m[1] == "-" {
+					body = strings.TrimLeft(body, "\t")
+				}
+				if body == m[3] {
+					break
+				}
+			}
+			if i == len(lines) {
+				return nil, fmt.Errorf("line %d: unterminated heredoc %s", instruction.Line, m[3])
+			}
+		}
+
+		if instruction.Cmd == "FROM" && len(instruction.Args) == 0 {
+			return nil, fmt.Errorf("line %d: FROM requires at least one argument", instruction.Line)
+		}
+		f.Instructions = append(f.Instructions, instruction)
+	}
+	return f, nil
+}
+
+type lineRange struct {
+	start int
+	end   int
+}
+
+func splitLines(src []byte) []lineRange {
+	var lines []lineRange
+	start := 0
+	for idx, b := range src {
+		if b == '\n' {
+			lines = append(lines, lineRange{start, idx})
+			start = idx + 1
+		}
+	}
+	if start < len(src) {
+		lines = append(lines, lineRange{start, len(src)})
+	}
+	return lines
+}
+
+// splitWords splits on whitespace outside of quotes
+func splitWords(text []byte, offsets []int) []Word {
+	var words []Word
+	var quote byte
+	start := -1
+	for idx := 0; idx <= len(text); idx++ {
+		if idx == len(text) || (quote == 0 && (text[idx] == ' ' || text[idx] == '\t')) {
+			if start >= 0 {
+				words = append(words, Word{
+					Value: string(text[start:idx]),
+					Start: offsets[start],
+					End:   offsets[idx-1] + 1,
+				})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = idx
+		}
+		switch {
+		case quote == 0 && (text[idx] == '"' || text[idx] == '\''):
+			quote = text[idx]
+		case quote != 0 && text[idx] == quote:
+			quote = 0
+		}
+	}
+	return words
+}
+
+// Froms returns every FROM instruction in the order they appear
+func (f *File) Froms() []From {
+	var froms []From
+	for _, instruction := range f.Instructions {
+		if instruction.Cmd != "FROM" {
+			continue
+		}
+		from := From{Instruction: instruction, Image: instruction.Args[0]}
+		for _, flag := range instruction.Flags {
+			if strings.HasPrefix(flag.Value, "--platform=") {
+				from.Platform = strings.TrimPrefix(flag.Value, "--platform=")
+			}
+		}
+		if len(instruction.Args) == 3 && strings.EqualFold(instruction.Args[1].Value, "AS") {
+			from.Alias = instruction.Args[2].Value
+		}
+		froms = append(froms, from)
+	}
+	return froms
+}
+
+// Args returns every ARG instruction in the order they appear
+func (f *File) Args() []Arg {
+	var args []Arg
+	global := true
+	for _, instruction := range f.Instructions {
+		if instruction.Cmd == "FROM" {
+			global = false
+			continue
+		}
+		if instruction.Cmd != "ARG" {
+			continue
+		}
+		for _, word := range instruction.Args {
+			arg := Arg{Instruction: instruction, Name: word.Value, Global: global}
+			if eq := strings.Index(word.Value, "="); eq >= 0 {
+				arg.Name = word.Value[:eq]
+				arg.HasDefault = true
+				arg.Default = unquote(Word{
+					Value: word.Value[eq+1:],
+					Start: word.Start + eq + 1,
+					End:   word.End,
+				})
+			}
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// GlobalArgs returns the defaults of the ARGs declared before the first FROM
+func (f *File) GlobalArgs() map[string]string {
+	vars := make(map[string]string)
+	for _, arg := range f.Args() {
+		if arg.Global && arg.HasDefault {
+			vars[arg.Name] = Expand(arg.Default.Value, vars)
+		}
+	}
+	return vars
+}
+
+// unquote strips matching quotes from around a word that has not been split across lines
+func unquote(w Word) Word {
+	if len(w.Value) >= 2 && w.End-w.Start == len(w.Value) {
+		first, last := w.Value[0], w.Value[len(w.Value)-1]
+		if (first == '"' || first == '\'') && first == last {
+			return Word{Value: w.Value[1 : len(w.Value)-1], Start: w.Start + 1, End: w.End - 1}
+		}
+	}
+	return w
+}
+
+// Replace replaces a word in the file with value.  Replacing the same word again overrides the earlier value.
+func (f *File) Replace(w Word, value string) {
+	f.edits[w.Start] = edit{end: w.End, value: value}
+}
+
+// Value returns the current value of a word taking any replacement into account
+func (f *File) Value(w Word) string {
+	if e, ok := f.edits[w.Start]; ok && e.end == w.End {
+		return e.value
+	}
+	return w.Value
+}
+
+// Bytes returns the original file with every replacement applied
+func (f *File) Bytes() []byte {
+	starts := make([]int, 0, len(f.edits))
+	for start := range f.edits {
+		starts = append(starts, start)
+	}
+	sort.Ints(starts)
+
+	var buf bytes.Buffer
+	pos := 0
+	for _, start := range starts {
+		buf.Write(f.src[pos:start])
+		buf.WriteString(f.edits[start].value)
+		pos = f.edits[start].end
+	}
+	buf.Write(f.src[pos:])
+	return buf.Bytes()
+}
+
+// Line returns the original text of the line number (starting at 1) with every replacement applied
+func (f *File) Line(number int) string {
+	lines := strings.Split(string(f.Bytes()), "\n")
+	if number < 1 || number > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[number-1], "\r")
+}
+
+var variableRegex = regexp.MustCompile(`\$(?:([a-zA-Z_][a-zA-Z0-9_]*)|\{([a-zA-Z_][a-zA-Z0-9_]*)(?:(:[-+])([^}]*))?\})`)
+
+// Expand substitutes $VAR, ${VAR}, ${VAR:-default} and ${VAR:+alternative} from vars.
+// Unknown variables expand to an empty string the same way docker does.
+func Expand(s string, vars map[string]string) string {
+	return variableRegex.ReplaceAllStringFunc(s, func(match string) string {
+		m := variableRegex.FindStringSubmatch(match)
+		name := m[1] + m[2]
+		value, ok := vars[name]
+		switch m[3] {
+		case ":-":
+			if !ok || value == "" {
+				return Expand(m[4], vars)
+			}
+		case ":+":
+			if ok && value != "" {
+				return Expand(m[4], vars)
+			}
+			return ""
+		}
+		return value
+	})
+}
+
+// Variables returns the names of the variables referenced in s
+func Variables(s string) []string {
+	var names []string
+	for _, m := range variableRegex.FindAllStringSubmatch(s, -1) {
+		names = append(names, m[1]+m[2])
+	}
+	return names
+}
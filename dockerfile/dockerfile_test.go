@@ -0,0 +1,250 @@
+package dockerfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFromReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		from     int
+		image    string
+		platform string
+		alias    string
+		line     int
+		replace  string
+		want     string
+	}{
+		{
+			name:    "lowercase from",
+			src:     "from registry/base:1.0.0\nrun echo hi\n",
+			image:   "registry/base:1.0.0",
+			line:    1,
+			replace: "registry/base:1.0.1",
+			want:    "from registry/base:1.0.1\nrun echo hi\n",
+		},
+		{
+			name:     "platform flag",
+			src:      "FROM --platform=$BUILDPLATFORM registry/base:1.0.0\n",
+			image:    "registry/base:1.0.0",
+			platform: "$BUILDPLATFORM",
+			line:     1,
+			replace:  "registry/base:2.0.0",
+			want:     "FROM --platform=$BUILDPLATFORM registry/base:2.0.0\n",
+		},
+		{
+			name:    "alias",
+			src:     "FROM registry/base:1.0.0 AS build\nRUN make\nFROM scratch\nCOPY --from=build /out /\n",
+			image:   "registry/base:1.0.0",
+			alias:   "build",
+			line:    1,
+			replace: "registry/base:1.1.0",
+			want:    "FROM registry/base:1.1.0 AS build\nRUN make\nFROM scratch\nCOPY --from=build /out /\n",
+		},
+		{
+			name:    "backslash continuation",
+			src:     "FROM \\\n    registry/base:1.0.0 \\\n    AS build\n",
+			image:   "registry/base:1.0.0",
+			alias:   "build",
+			line:    1,
+			replace: "registry/base:1.0.1",
+			want:    "FROM \\\n    registry/base:1.0.1 \\\n    AS build\n",
+		},
+		{
+			name:    "backtick escape directive",
+			src:     "# escape=`\nFROM `\n  registry/base:1.0.0\nRUN dir c:\\\n",
+			image:   "registry/base:1.0.0",
+			line:    2,
+			replace: "registry/base:1.0.1",
+			want:    "# escape=`\nFROM `\n  registry/base:1.0.1\nRUN dir c:\\\n",
+		},
+		{
+			name:    "comment inside continuation",
+			src:     "FROM \\\n# the base image\n\n    registry/base:1.0.0\n",
+			image:   "registry/base:1.0.0",
+			line:    1,
+			replace: "registry/base:1.0.1",
+			want:    "FROM \\\n# the base image\n\n    registry/base:1.0.1\n",
+		},
+		{
+			name:    "heredoc body containing FROM",
+			src:     "FROM registry/base:1.0.0\nRUN <<EOF\nFROM registry/other:9.9.9\nEOF\nFROM registry/base:1.0.0 AS two\n",
+			from:    1,
+			image:   "registry/base:1.0.0",
+			alias:   "two",
+			line:    5,
+			replace: "registry/base:1.0.1",
+			want:    "FROM registry/base:1.0.0\nRUN <<EOF\nFROM registry/other:9.9.9\nEOF\nFROM registry/base:1.0.1 AS two\n",
+		},
+		{
+			name:    "crlf",
+			src:     "FROM registry/base:1.0.0 \\\r\n  AS build\r\nRUN make\r\n",
+			image:   "registry/base:1.0.0",
+			alias:   "build",
+			line:    1,
+			replace: "registry/base:1.0.1",
+			want:    "FROM registry/base:1.0.1 \\\r\n  AS build\r\nRUN make\r\n",
+		},
+		{
+			name:    "registry port and digest",
+			src:     "FROM registry:5000/x:1.0@sha256:0123abcd\n",
+			image:   "registry:5000/x:1.0@sha256:0123abcd",
+			line:    1,
+			replace: "registry:5000/x:1.1",
+			want:    "FROM registry:5000/x:1.1\n",
+		},
+		{
+			name:    "arg with default",
+			src:     "ARG BASE=registry/base\nFROM ${BASE:-registry/other}:1.0.0\n",
+			image:   "${BASE:-registry/other}:1.0.0",
+			line:    2,
+			replace: "${BASE:-registry/other}:1.0.1",
+			want:    "ARG BASE=registry/base\nFROM ${BASE:-registry/other}:1.0.1\n",
+		},
+		{
+			name:    "byte order mark",
+			src:     "\xef\xbb\xbfFROM registry/base:1.0.0\n",
+			image:   "registry/base:1.0.0",
+			line:    1,
+			replace: "registry/base:1.0.1",
+			want:    "\xef\xbb\xbfFROM registry/base:1.0.1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := Parse([]byte(test.src))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := string(f.Bytes()); got != test.src {
+				t.Fatalf("Bytes() before Replace = %q, want %q", got, test.src)
+			}
+			froms := f.Froms()
+			if len(froms) <= test.from {
+				t.Fatalf("Froms() = %d FROMs, want more than %d", len(froms), test.from)
+			}
+			from := froms[test.from]
+			if from.Image.Value != test.image {
+				t.Errorf("Image = %q, want %q", from.Image.Value, test.image)
+			}
+			if from.Platform != test.platform {
+				t.Errorf("Platform = %q, want %q", from.Platform, test.platform)
+			}
+			if from.Alias != test.alias {
+				t.Errorf("Alias = %q, want %q", from.Alias, test.alias)
+			}
+			if from.Instruction.Line != test.line {
+				t.Errorf("Line = %d, want %d", from.Instruction.Line, test.line)
+			}
+			f.Replace(from.Image, test.replace)
+			if got := string(f.Bytes()); got != test.want {
+				t.Errorf("Bytes() = %q, want %q", got, test.want)
+			}
+			if got := f.Value(from.Image); got != test.replace {
+				t.Errorf("Value() = %q, want %q", got, test.replace)
+			}
+		})
+	}
+}
+
+func TestParseHeredocOnlyFrom(t *testing.T) {
+	f, err := Parse([]byte("FROM registry/base:1.0.0\nCOPY <<-'EOT' /script.sh\n\tFROM registry/other:1.0.0\n\tEOT\n"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if froms := f.Froms(); len(froms) != 1 {
+		t.Errorf("Froms() = %d FROMs, want 1", len(froms))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"FROM\n",
+		"# escape=x\nFROM scratch\n",
+		"FROM scratch\nRUN <<EOF\necho never ends\n",
+	} {
+		if _, err := Parse([]byte(src)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestArgReplace(t *testing.T) {
+	src := "ARG VERSION=\"1.0.0\"\nARG OTHER\nFROM registry/base:${VERSION}\nARG LOCAL=1\n"
+	f, err := Parse([]byte(src))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	args := f.Args()
+	if len(args) != 3 {
+		t.Fatalf("Args() = %d ARGs, want 3", len(args))
+	}
+	if !args[0].Global || !args[0].HasDefault || args[0].Default.Value != "1.0.0" {
+		t.Errorf("Args()[0] = %+v, want a global ARG defaulting to 1.0.0", args[0])
+	}
+	if args[1].HasDefault {
+		t.Errorf("Args()[1] = %+v, want no default", args[1])
+	}
+	if args[2].Global {
+		t.Errorf("Args()[2] = %+v, want a stage ARG", args[2])
+	}
+	if got := f.GlobalArgs(); !reflect.DeepEqual(got, map[string]string{"VERSION": "1.0.0"}) {
+		t.Errorf("GlobalArgs() = %v", got)
+	}
+
+	f.Replace(args[0].Default, "1.0.1")
+	want := strings.Replace(src, "1.0.0", "1.0.1", 1)
+	if got := string(f.Bytes()); got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+	if got := f.Line(1); got != "ARG VERSION=\"1.0.1\"" {
+		t.Errorf("Line(1) = %q", got)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"A": "a", "EMPTY": ""}
+	tests := map[string]string{
+		"$A":                "a",
+		"${A}":              "a",
+		"${MISSING}":        "",
+		"${MISSING:-x}":     "x",
+		"${EMPTY:-x}":       "x",
+		"${A:-x}":           "a",
+		"${A:+x}":           "x",
+		"${MISSING:+x}":     "",
+		"registry/$A:1.0.0": "registry/a:1.0.0",
+	}
+	for s, want := range tests {
+		if got := Expand(s, vars); got != want {
+			t.Errorf("Expand(%q) = %q, want %q", s, got, want)
+		}
+	}
+	if got := Variables("${A:-x}/$B:${C}"); !reflect.DeepEqual(got, []string{"A", "B", "C"}) {
+		t.Errorf("Variables() = %v", got)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	tests := map[string]Reference{
+		"alpine":                         {Name: "alpine"},
+		"alpine:3.9":                     {Name: "alpine", Tag: "3.9"},
+		"registry:5000/x":                {Name: "registry:5000/x"},
+		"registry:5000/x:1.0":            {Name: "registry:5000/x", Tag: "1.0"},
+		"registry:5000/x:1.0@sha256:abc": {Name: "registry:5000/x", Tag: "1.0", Digest: "sha256:abc"},
+		"registry/x@sha256:abc":          {Name: "registry/x", Digest: "sha256:abc"},
+		"registry/x:1.2.3-rc.0_build.5":  {Name: "registry/x", Tag: "1.2.3-rc.0_build.5"},
+	}
+	for image, want := range tests {
+		got := ParseReference(image)
+		if got != want {
+			t.Errorf("ParseReference(%q) = %+v, want %+v", image, got, want)
+		}
+		if got.String() != image {
+			t.Errorf("ParseReference(%q).String() = %q", image, got.String())
+		}
+	}
+}
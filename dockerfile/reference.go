@@ -0,0 +1,38 @@
+package dockerfile
+
+import "strings"
+
+// Reference is an image reference in the form name[:tag][@digest]
+type Reference struct {
+	Name   string
+	Tag    string
+	Digest string
+}
+
+// ParseReference splits an image reference into its name, tag and digest.
+// A colon before the last slash is a registry port, not a tag, e.g. registry:5000/x:1.0.
+func ParseReference(image string) Reference {
+	ref := Reference{}
+	if at := strings.Index(image, "@"); at >= 0 {
+		ref.Digest = image[at+1:]
+		image = image[:at]
+	}
+	if colon := strings.LastIndex(image, ":"); colon > strings.LastIndex(image, "/") {
+		ref.Tag = image[colon+1:]
+		image = image[:colon]
+	}
+	ref.Name = image
+	return ref
+}
+
+// String joins the reference back together
+func (r Reference) String() string {
+	image := r.Name
+	if r.Tag != "" {
+		image = image + ":" + r.Tag
+	}
+	if r.Digest != "" {
+		image = image + "@" + r.Digest
+	}
+	return image
+}
@@ -36,3 +36,20 @@ mkdir test_dirs/charlie-1
 echo "FROM docker/registry/charlie:1.0.0" > test_dirs/charlie-1/Dockerfile
 echo "RUN sleep 1" >> test_dirs/charlie-1/Dockerfile
 echo "0.1.0" > test_dirs/charlie-1/VERSION
+
+mkdir test_dirs/alpha-charlie
+echo "FROM docker/registry/alpha:1.0.0 AS build" > test_dirs/alpha-charlie/Dockerfile
+echo "RUN sleep 1" >> test_dirs/alpha-charlie/Dockerfile
+echo "FROM docker/registry/charlie-1:0.1.0" >> test_dirs/alpha-charlie/Dockerfile
+echo "RUN sleep 1" >> test_dirs/alpha-charlie/Dockerfile
+echo "0.1.0" > test_dirs/alpha-charlie/VERSION
+
+mkdir -p test_dirs/languages/python
+echo "FROM docker/registry/alpha:1.0.0" > test_dirs/languages/python/Dockerfile
+echo "RUN sleep 1" >> test_dirs/languages/python/Dockerfile
+echo "3.7.0" > test_dirs/languages/python/VERSION
+
+mkdir -p test_dirs/apps/foo
+echo "FROM docker/registry/languages/python:3.7.0" > test_dirs/apps/foo/Dockerfile
+echo "RUN sleep 1" >> test_dirs/apps/foo/Dockerfile
+echo "0.1.0" > test_dirs/apps/foo/VERSION